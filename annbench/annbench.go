@@ -2,6 +2,7 @@ package annbench
 
 import (
 	"container/heap"
+	"context"
 	lsh "github.com/gasparian/lsh-search-go/lsh"
 	"github.com/gasparian/lsh-search-go/store"
 	guuid "github.com/google/uuid"
@@ -34,6 +35,10 @@ type SearchConfig struct {
 	Epsilon       float64
 	MaxCandidates int
 	BatchSize     int
+	PQSubspaces   int
+	PQIterations  int
+	RerankTop     int
+	CompactStore  bool
 }
 
 type BenchData struct {
@@ -69,13 +74,14 @@ func NewNNMock(maxCandidates int, store store.Store, metric lsh.Metric) *NNMock
 }
 
 func (nn *NNMock) Train(vecs [][]float64, ids []string) error {
-	err := nn.index.Clear()
+	ctx := context.Background()
+	err := nn.index.Clear(ctx)
 	if err != nil {
 		return err
 	}
 	for i, vec := range vecs {
-		nn.index.SetVector(ids[i], vec)
-		nn.index.SetHash("0", ids[i])
+		nn.index.SetVector(ctx, ids[i], vec)
+		nn.index.SetHash(ctx, store.BucketKey{}, ids[i])
 	}
 	return nil
 }
@@ -85,10 +91,15 @@ func (nn *NNMock) Search(query []float64, maxNN int, distanceThrsh float64) ([]l
 	maxCandidates := nn.MaxCandidates
 	nn.mx.RUnlock()
 
+	ctx := context.Background()
 	closestSet := make(map[string]bool)
 	minHeap := new(lsh.NeighborMinHeap)
 
-	iter, _ := nn.index.GetHashIterator("0")
+	iter, err := nn.index.GetHashIterator(ctx, store.BucketKey{})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
 	for {
 		if minHeap.Len() >= maxCandidates {
 			break
@@ -100,7 +111,7 @@ func (nn *NNMock) Search(query []float64, maxNN int, distanceThrsh float64) ([]l
 		if closestSet[id] {
 			continue
 		}
-		vec, err := nn.index.GetVector(id)
+		vec, err := nn.index.GetVector(ctx, id)
 		if err != nil {
 			return nil, err
 		}
@@ -117,6 +128,9 @@ func (nn *NNMock) Search(query []float64, maxNN int, distanceThrsh float64) ([]l
 			)
 		}
 	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
 	closest := make([]lsh.Neighbor, 0)
 	for i := 0; i < maxNN && minHeap.Len() > 0; i++ {
 		closest = append(closest, *heap.Pop(minHeap).(*lsh.Neighbor))
@@ -124,6 +138,14 @@ func (nn *NNMock) Search(query []float64, maxNN int, distanceThrsh float64) ([]l
 	return closest, nil
 }
 
+// VectorsMemory returns approximate number of bytes the store needs to hold vectors
+func VectorsMemory(nVecs, nDims int, codec lsh.VectorCodec) int {
+	if codec == nil {
+		return nVecs * nDims * 8
+	}
+	return nVecs * codec.CodeSize()
+}
+
 func GetFloat64Range(data [][]float64) (float64, float64) {
 	min, max := math.MaxFloat64, -math.MaxFloat64
 	cpy := make([]float64, len(data[0]))
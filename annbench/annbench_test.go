@@ -1,8 +1,11 @@
 package annbench_test
 
 import (
+	"context"
 	bench "github.com/gasparian/lsh-search-go/annbench"
 	lsh "github.com/gasparian/lsh-search-go/lsh"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/compact"
 	"github.com/gasparian/lsh-search-go/store/kv"
 	"sync"
 	"sync/atomic"
@@ -99,12 +102,39 @@ func testLSH(t *testing.T, config *bench.SearchConfig, data *bench.BenchData) {
 			Dims:     config.NDims,
 		},
 	}
-	s := kv.NewKVStore()
+	var s store.Store = kv.NewKVStore()
+	if config.CompactStore {
+		s = compact.NewCompactStore()
+	}
+	if config.PQSubspaces > 0 {
+		lshConfig.Codec = lsh.NewProductQuantizer(config.PQSubspaces, config.PQIterations, 10000)
+		if config.RerankTop > 0 {
+			exact := kv.NewKVStore()
+			for i, vec := range data.TrainVecs {
+				exact.SetVector(context.Background(), data.TrainIds[i], vec)
+			}
+			lshConfig.RerankTop = config.RerankTop
+			lshConfig.ExactVectors = exact
+		}
+	}
 	lshIndex, err := lsh.NewLsh(lshConfig, s, config.Metric)
 	if err != nil {
 		t.Fatal(err)
 	}
 	testIndexer(t, lshIndex, data, config)
+	memory := bench.VectorsMemory(len(data.TrainVecs), config.NDims, lshConfig.Codec)
+	t.Logf("Vectors memory in the store: %.2f Mb", float64(memory)/(1<<20))
+	if cs, ok := s.(*compact.CompactStore); ok {
+		usage := cs.MemoryUsage()
+		t.Logf(
+			"Compact store memory: total %.2f Mb (vectors %.2f Mb, codes %.2f Mb, postings %.2f Mb, ids %.2f Mb)",
+			float64(usage.Total())/(1<<20),
+			float64(usage.Vectors)/(1<<20),
+			float64(usage.Codes)/(1<<20),
+			float64(usage.Postings)/(1<<20),
+			float64(usage.IDs)/(1<<20),
+		)
+	}
 }
 
 func TestEuclideanFashionMnist(t *testing.T) {
@@ -151,6 +181,19 @@ func TestEuclideanFashionMnist(t *testing.T) {
 	t.Run("LSH", func(t *testing.T) {
 		testLSH(t, config, data)
 	})
+
+	pqConfig := *config
+	pqConfig.PQSubspaces = 98
+	pqConfig.PQIterations = 10
+	t.Run("LSH-PQ", func(t *testing.T) {
+		testLSH(t, &pqConfig, data)
+	})
+
+	compactConfig := *config
+	compactConfig.CompactStore = true
+	t.Run("LSH-Compact", func(t *testing.T) {
+		testLSH(t, &compactConfig, data)
+	})
 }
 
 func TestEuclideanSift(t *testing.T) {
@@ -199,6 +242,13 @@ func TestEuclideanSift(t *testing.T) {
 	t.Run("LSH", func(t *testing.T) {
 		testLSH(t, config, data)
 	})
+
+	pqConfig := *config
+	pqConfig.PQSubspaces = 32
+	pqConfig.PQIterations = 10
+	t.Run("LSH-PQ", func(t *testing.T) {
+		testLSH(t, &pqConfig, data)
+	})
 }
 
 func TestAngularNYTimes(t *testing.T) {
@@ -0,0 +1,439 @@
+package lsh
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+)
+
+var (
+	codecNotTrainedErr = errors.New("Codec must be trained first")
+	codeLengthErr      = errors.New("Code length doesn't match the codec")
+	subspacesNumberErr = errors.New("Number of subspaces must be in range [1, dims]")
+)
+
+const (
+	pqCentroids = 256 // NOTE: 8-bit codes
+)
+
+// CodeDistance calculates distance between the prepared query and the encoded vector
+type CodeDistance func(code []byte) float64
+
+// VectorCodec compresses vectors before putting them into the store
+type VectorCodec interface {
+	Train(vecs [][]float64) error
+	Encode(vec []float64) ([]byte, error)
+	Decode(code []byte) ([]float64, error)
+	NewDistance(query []float64, metric Metric) (CodeDistance, error)
+	CodeSize() int
+}
+
+// decodedDistance is a fallback for the metrics that can't be calculated on codes directly
+func decodedDistance(codec VectorCodec, query []float64, metric Metric) CodeDistance {
+	return func(code []byte) float64 {
+		vec, err := codec.Decode(code)
+		if err != nil {
+			return math.MaxFloat64
+		}
+		return metric.GetDist(vec, query)
+	}
+}
+
+// ProductQuantizer splits vectors into subspaces and encodes
+// every part as an index of the closest k-means centroid
+type ProductQuantizer struct {
+	mx         sync.RWMutex
+	subspaces  int
+	iterations int
+	sampleSize int
+	offsets    []int
+	centroids  [][][]float64
+}
+
+// NewProductQuantizer creates PQ codec, which produces one byte per subspace;
+// k-means runs given number of iterations over the random sample of the train vectors
+func NewProductQuantizer(subspaces, iterations, sampleSize int) *ProductQuantizer {
+	return &ProductQuantizer{
+		subspaces:  subspaces,
+		iterations: iterations,
+		sampleSize: sampleSize,
+	}
+}
+
+func sqDist(l, r []float64) float64 {
+	var dist float64
+	for i := range l {
+		diff := l[i] - r[i]
+		dist += diff * diff
+	}
+	return dist
+}
+
+func closestCentroid(vec []float64, centroids [][]float64) int {
+	closest := 0
+	minDist := math.MaxFloat64
+	for i, c := range centroids {
+		dist := sqDist(vec, c)
+		if dist < minDist {
+			minDist = dist
+			closest = i
+		}
+	}
+	return closest
+}
+
+// kMeans clusters vectors with the Lloyd's algorithm
+func kMeans(vecs [][]float64, k, iterations int) [][]float64 {
+	if k > len(vecs) {
+		k = len(vecs)
+	}
+	centroids := make([][]float64, k)
+	for i, idx := range rand.Perm(len(vecs))[:k] {
+		centroids[i] = make([]float64, len(vecs[idx]))
+		copy(centroids[i], vecs[idx])
+	}
+	assignment := make([]int, len(vecs))
+	counts := make([]int, k)
+	for it := 0; it < iterations; it++ {
+		for i, vec := range vecs {
+			assignment[i] = closestCentroid(vec, centroids)
+		}
+		for i := range counts {
+			counts[i] = 0
+		}
+		sums := make([][]float64, k)
+		for i := range sums {
+			sums[i] = make([]float64, len(centroids[i]))
+		}
+		for i, vec := range vecs {
+			c := assignment[i]
+			counts[c]++
+			for j, v := range vec {
+				sums[c][j] += v
+			}
+		}
+		for i := range centroids {
+			// NOTE: keep the previous position of the empty cluster
+			if counts[i] == 0 {
+				continue
+			}
+			for j := range sums[i] {
+				centroids[i][j] = sums[i][j] / float64(counts[i])
+			}
+		}
+	}
+	return centroids
+}
+
+// Train learns centroids for every subspace
+func (pq *ProductQuantizer) Train(vecs [][]float64) error {
+	if len(vecs) == 0 {
+		return dataSliceEmptyErr
+	}
+	dims := len(vecs[0])
+	if pq.subspaces < 1 || pq.subspaces > dims {
+		return subspacesNumberErr
+	}
+	sample := vecs
+	if pq.sampleSize > 0 && len(vecs) > pq.sampleSize {
+		sample = make([][]float64, pq.sampleSize)
+		for i, idx := range rand.Perm(len(vecs))[:pq.sampleSize] {
+			sample[i] = vecs[idx]
+		}
+	}
+	offsets := make([]int, pq.subspaces+1)
+	for m := 0; m <= pq.subspaces; m++ {
+		offsets[m] = m * dims / pq.subspaces
+	}
+	centroids := make([][][]float64, pq.subspaces)
+	wg := sync.WaitGroup{}
+	wg.Add(pq.subspaces)
+	for m := 0; m < pq.subspaces; m++ {
+		go func(m int) {
+			defer wg.Done()
+			subVecs := make([][]float64, len(sample))
+			for i, vec := range sample {
+				subVecs[i] = vec[offsets[m]:offsets[m+1]]
+			}
+			centroids[m] = kMeans(subVecs, pqCentroids, pq.iterations)
+		}(m)
+	}
+	wg.Wait()
+
+	pq.mx.Lock()
+	defer pq.mx.Unlock()
+	pq.offsets = offsets
+	pq.centroids = centroids
+	return nil
+}
+
+// Encode returns indexes of the closest centroids in every subspace
+func (pq *ProductQuantizer) Encode(vec []float64) ([]byte, error) {
+	pq.mx.RLock()
+	defer pq.mx.RUnlock()
+	if pq.centroids == nil {
+		return nil, codecNotTrainedErr
+	}
+	if len(vec) != pq.offsets[pq.subspaces] {
+		return nil, dimensionsNumberErr
+	}
+	code := make([]byte, pq.subspaces)
+	for m := range code {
+		code[m] = byte(closestCentroid(vec[pq.offsets[m]:pq.offsets[m+1]], pq.centroids[m]))
+	}
+	return code, nil
+}
+
+// Decode restores approximate vector from the centroids
+func (pq *ProductQuantizer) Decode(code []byte) ([]float64, error) {
+	pq.mx.RLock()
+	defer pq.mx.RUnlock()
+	if pq.centroids == nil {
+		return nil, codecNotTrainedErr
+	}
+	if len(code) != pq.subspaces {
+		return nil, codeLengthErr
+	}
+	vec := make([]float64, 0, pq.offsets[pq.subspaces])
+	for m, c := range code {
+		vec = append(vec, pq.centroids[m][c]...)
+	}
+	return vec, nil
+}
+
+// NewDistance builds lookup tables of distances between query parts and centroids,
+// so the distance to the encoded vector is just a sum of table values (asymmetric distance computation)
+func (pq *ProductQuantizer) NewDistance(query []float64, metric Metric) (CodeDistance, error) {
+	pq.mx.RLock()
+	defer pq.mx.RUnlock()
+	if pq.centroids == nil {
+		return nil, codecNotTrainedErr
+	}
+	if len(query) != pq.offsets[pq.subspaces] {
+		return nil, dimensionsNumberErr
+	}
+	switch metric.(type) {
+	case L2:
+		table := make([][]float64, pq.subspaces)
+		for m := range table {
+			subQuery := query[pq.offsets[m]:pq.offsets[m+1]]
+			table[m] = make([]float64, len(pq.centroids[m]))
+			for k, c := range pq.centroids[m] {
+				table[m][k] = sqDist(subQuery, c)
+			}
+		}
+		return func(code []byte) float64 {
+			var dist float64
+			for m, c := range code {
+				dist += table[m][c]
+			}
+			return math.Sqrt(dist)
+		}, nil
+	case Angular:
+		var queryNorm float64
+		dots := make([][]float64, pq.subspaces)
+		norms := make([][]float64, pq.subspaces)
+		for m := range dots {
+			subQuery := query[pq.offsets[m]:pq.offsets[m+1]]
+			queryNorm += sqDist(subQuery, make([]float64, len(subQuery)))
+			dots[m] = make([]float64, len(pq.centroids[m]))
+			norms[m] = make([]float64, len(pq.centroids[m]))
+			for k, c := range pq.centroids[m] {
+				for j := range c {
+					dots[m][k] += c[j] * subQuery[j]
+					norms[m][k] += c[j] * c[j]
+				}
+			}
+		}
+		queryNorm = math.Sqrt(queryNorm)
+		return func(code []byte) float64 {
+			var dot, norm float64
+			for m, c := range code {
+				dot += dots[m][c]
+				norm += norms[m][c]
+			}
+			var dist float64 = 1.0
+			lrNorm := queryNorm * math.Sqrt(norm)
+			if lrNorm > tol {
+				dist = 1.0 - dot/lrNorm
+			}
+			if dist < tol {
+				return 0.0
+			}
+			return dist
+		}, nil
+	}
+	return decodedDistance(pq, query, metric), nil
+}
+
+// CodeSize returns number of bytes per encoded vector
+func (pq *ProductQuantizer) CodeSize() int {
+	return pq.subspaces
+}
+
+// ScalarQuantizer encodes every dimension of a vector as a single byte,
+// mapping the dimension range to [0, 255]
+type ScalarQuantizer struct {
+	mx         sync.RWMutex
+	sampleSize int
+	stdRange   float64
+	min        []float64
+	scale      []float64
+}
+
+// NewScalarQuantizer creates codec which uses per-dimension min/max of the train vectors
+func NewScalarQuantizer() *ScalarQuantizer {
+	return &ScalarQuantizer{}
+}
+
+// NewStdScalarQuantizer creates codec which maps the [mean - stdRange*std, mean + stdRange*std] range
+// of every dimension, using mean and std calculated on a sample of the train vectors
+func NewStdScalarQuantizer(sampleSize int, stdRange float64) *ScalarQuantizer {
+	return &ScalarQuantizer{
+		sampleSize: sampleSize,
+		stdRange:   stdRange,
+	}
+}
+
+// Train calculates ranges of the dimensions
+func (sq *ScalarQuantizer) Train(vecs [][]float64) error {
+	if len(vecs) == 0 {
+		return dataSliceEmptyErr
+	}
+	dims := len(vecs[0])
+	min := make([]float64, dims)
+	max := make([]float64, dims)
+	if sq.sampleSize > 0 {
+		mean, std, err := GetMeanStdSampled(vecs, sq.sampleSize)
+		if err != nil {
+			return err
+		}
+		for j := range mean {
+			min[j] = mean[j] - sq.stdRange*std[j]
+			max[j] = mean[j] + sq.stdRange*std[j]
+		}
+	} else {
+		copy(min, vecs[0])
+		copy(max, vecs[0])
+		for _, vec := range vecs {
+			for j, v := range vec {
+				min[j] = math.Min(min[j], v)
+				max[j] = math.Max(max[j], v)
+			}
+		}
+	}
+	scale := make([]float64, dims)
+	for j := range scale {
+		scale[j] = (max[j] - min[j]) / math.MaxUint8
+		if scale[j] < tol {
+			scale[j] = tol
+		}
+	}
+
+	sq.mx.Lock()
+	defer sq.mx.Unlock()
+	sq.min = min
+	sq.scale = scale
+	return nil
+}
+
+// Encode quantizes every dimension, values outside the range are clamped
+func (sq *ScalarQuantizer) Encode(vec []float64) ([]byte, error) {
+	sq.mx.RLock()
+	defer sq.mx.RUnlock()
+	if sq.min == nil {
+		return nil, codecNotTrainedErr
+	}
+	if len(vec) != len(sq.min) {
+		return nil, dimensionsNumberErr
+	}
+	code := make([]byte, len(vec))
+	for j, v := range vec {
+		q := math.Round((v - sq.min[j]) / sq.scale[j])
+		code[j] = byte(math.Max(0, math.Min(math.MaxUint8, q)))
+	}
+	return code, nil
+}
+
+// Decode restores approximate vector
+func (sq *ScalarQuantizer) Decode(code []byte) ([]float64, error) {
+	sq.mx.RLock()
+	defer sq.mx.RUnlock()
+	if sq.min == nil {
+		return nil, codecNotTrainedErr
+	}
+	if len(code) != len(sq.min) {
+		return nil, codeLengthErr
+	}
+	vec := make([]float64, len(code))
+	for j, c := range code {
+		vec[j] = sq.min[j] + float64(c)*sq.scale[j]
+	}
+	return vec, nil
+}
+
+// NewDistance prepares query in the quantized space, so the distance is calculated on codes without decoding
+func (sq *ScalarQuantizer) NewDistance(query []float64, metric Metric) (CodeDistance, error) {
+	sq.mx.RLock()
+	defer sq.mx.RUnlock()
+	if sq.min == nil {
+		return nil, codecNotTrainedErr
+	}
+	if len(query) != len(sq.min) {
+		return nil, dimensionsNumberErr
+	}
+	switch metric.(type) {
+	case L2:
+		quantized := make([]float64, len(query))
+		weights := make([]float64, len(query))
+		for j, v := range query {
+			quantized[j] = (v - sq.min[j]) / sq.scale[j]
+			weights[j] = sq.scale[j] * sq.scale[j]
+		}
+		return func(code []byte) float64 {
+			var dist float64
+			for j, c := range code {
+				diff := float64(c) - quantized[j]
+				dist += weights[j] * diff * diff
+			}
+			return math.Sqrt(dist)
+		}, nil
+	case Angular:
+		min := sq.min
+		scale := sq.scale
+		var queryNorm, queryMinDot float64
+		scaledQuery := make([]float64, len(query))
+		for j, v := range query {
+			queryNorm += v * v
+			queryMinDot += v * min[j]
+			scaledQuery[j] = v * scale[j]
+		}
+		queryNorm = math.Sqrt(queryNorm)
+		return func(code []byte) float64 {
+			dot, norm := queryMinDot, 0.0
+			for j, c := range code {
+				dot += float64(c) * scaledQuery[j]
+				v := min[j] + float64(c)*scale[j]
+				norm += v * v
+			}
+			var dist float64 = 1.0
+			lrNorm := queryNorm * math.Sqrt(norm)
+			if lrNorm > tol {
+				dist = 1.0 - dot/lrNorm
+			}
+			if dist < tol {
+				return 0.0
+			}
+			return dist
+		}, nil
+	}
+	return decodedDistance(sq, query, metric), nil
+}
+
+// CodeSize returns number of bytes per encoded vector
+func (sq *ScalarQuantizer) CodeSize() int {
+	sq.mx.RLock()
+	defer sq.mx.RUnlock()
+	return len(sq.min)
+}
@@ -0,0 +1,225 @@
+package lsh
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gonum.org/v1/gonum/blas/blas64"
+	"io"
+	"math"
+)
+
+var (
+	treeIndexErr      = errors.New("Tree index is out of range")
+	svgDimensionsErr  = errors.New("Only 2D vectors could be drawn")
+	svgEmptyVectorErr = errors.New("At least one vector is needed to draw the tree")
+)
+
+const (
+	svgSize      = 600.0
+	svgMargin    = 0.05
+	svgPointSize = 3.0
+)
+
+// ExportedNode is a serializable view of the tree node
+type ExportedNode struct {
+	Normal     []float64     `json:"normal,omitempty"`
+	NormalNorm float64       `json:"normal_norm,omitempty"`
+	Offset     float64       `json:"offset"`
+	Size       int           `json:"size"`
+	IsLeaf     bool          `json:"is_leaf"`
+	LeafID     *uint64       `json:"leaf_id,omitempty"`
+	Left       *ExportedNode `json:"left,omitempty"`
+	Right      *ExportedNode `json:"right,omitempty"`
+}
+
+func exportNode(node *treeNode) *ExportedNode {
+	if node == nil {
+		return nil
+	}
+	if node.plane == nil {
+		// NOTE: leaf id is a pointer, so the first leaf keeps its zero id in JSON
+		leafID := node.leafID
+		return &ExportedNode{
+			Size:   node.size,
+			IsLeaf: true,
+			LeafID: &leafID,
+		}
+	}
+	normal := make([]float64, node.plane.n.N)
+	copy(normal, node.plane.n.Data)
+	return &ExportedNode{
+		Normal:     normal,
+		NormalNorm: blas64.Nrm2(node.plane.n),
+		Offset:     node.plane.d,
+		Size:       node.size,
+		Left:       exportNode(node.left),
+		Right:      exportNode(node.right),
+	}
+}
+
+// exportTrees returns copies of all trees
+func (hasher *Hasher) exportTrees() []*ExportedNode {
+	hasher.mutex.RLock()
+	defer hasher.mutex.RUnlock()
+
+	trees := make([]*ExportedNode, len(hasher.trees))
+	for i, tree := range hasher.trees {
+		trees[i] = exportNode(tree)
+	}
+	return trees
+}
+
+// ExportTrees returns serializable copies of the hasher trees
+func (lsh *LSHIndex) ExportTrees() []*ExportedNode {
+	return lsh.hasher.exportTrees()
+}
+
+// WriteTreesJSON writes all trees as a JSON array
+func (lsh *LSHIndex) WriteTreesJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(lsh.hasher.exportTrees())
+}
+
+// writeDOTNode writes node with its subtrees and returns the node name
+func writeDOTNode(w *bufio.Writer, node *ExportedNode, perm int, counter *int) string {
+	name := fmt.Sprintf("t%v_n%v", perm, *counter)
+	*counter++
+	if node.IsLeaf {
+		fmt.Fprintf(w, "    %v [shape=box, label=\"leaf %v\\nsize=%v\"];\n", name, *node.LeafID, node.Size)
+		return name
+	}
+	fmt.Fprintf(w, "    %v [label=\"d=%.4g\\n|n|=%.4g\\nsize=%v\"];\n", name, node.Offset, node.NormalNorm, node.Size)
+	left := writeDOTNode(w, node.Left, perm, counter)
+	right := writeDOTNode(w, node.Right, perm, counter)
+	fmt.Fprintf(w, "    %v -> %v [label=\"<0\"];\n", name, left)
+	fmt.Fprintf(w, "    %v -> %v [label=\">=0\"];\n", name, right)
+	return name
+}
+
+// WriteTreesDOT writes all trees as a Graphviz graph, one cluster per tree
+func (lsh *LSHIndex) WriteTreesDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph lsh {")
+	for perm, tree := range lsh.hasher.exportTrees() {
+		if tree == nil {
+			continue
+		}
+		fmt.Fprintf(bw, "  subgraph cluster_%v {\n    label=\"tree %v\";\n", perm, perm)
+		counter := 0
+		writeDOTNode(bw, tree, perm, &counter)
+		fmt.Fprintln(bw, "  }")
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+type point2D struct {
+	x, y float64
+}
+
+func planeValue(p point2D, node *ExportedNode) float64 {
+	return node.Normal[0]*p.x + node.Normal[1]*p.y - node.Offset
+}
+
+// clipPolygon keeps the part of the convex polygon which lies on the given side of the node plane
+func clipPolygon(poly []point2D, node *ExportedNode, left bool) []point2D {
+	inside := func(v float64) bool {
+		return math.Signbit(v) == left
+	}
+	clipped := make([]point2D, 0, len(poly)+1)
+	for i := range poly {
+		a, b := poly[i], poly[(i+1)%len(poly)]
+		va, vb := planeValue(a, node), planeValue(b, node)
+		if inside(va) {
+			clipped = append(clipped, a)
+		}
+		if inside(va) != inside(vb) {
+			t := va / (va - vb)
+			clipped = append(clipped, point2D{a.x + (b.x-a.x)*t, a.y + (b.y-a.y)*t})
+		}
+	}
+	return clipped
+}
+
+// planeSegment returns the part of the node plane inside the convex polygon
+func planeSegment(poly []point2D, node *ExportedNode) ([]point2D, bool) {
+	segment := make([]point2D, 0, 2)
+	for i := range poly {
+		a, b := poly[i], poly[(i+1)%len(poly)]
+		va, vb := planeValue(a, node), planeValue(b, node)
+		if math.Signbit(va) != math.Signbit(vb) {
+			t := va / (va - vb)
+			segment = append(segment, point2D{a.x + (b.x-a.x)*t, a.y + (b.y-a.y)*t})
+		}
+	}
+	return segment, len(segment) == 2
+}
+
+// svgCanvas maps data coordinates to the picture ones
+type svgCanvas struct {
+	w                      *bufio.Writer
+	minX, minY, maxX, maxY float64
+}
+
+func (c *svgCanvas) toPicture(p point2D) (float64, float64) {
+	x := (p.x - c.minX) / (c.maxX - c.minX) * svgSize
+	y := svgSize - (p.y-c.minY)/(c.maxY-c.minY)*svgSize
+	return x, y
+}
+
+func (c *svgCanvas) drawPlanes(node *ExportedNode, cell []point2D) {
+	if node == nil || node.IsLeaf || len(cell) < 3 {
+		return
+	}
+	if segment, ok := planeSegment(cell, node); ok {
+		x1, y1 := c.toPicture(segment[0])
+		x2, y2 := c.toPicture(segment[1])
+		fmt.Fprintf(c.w, "  <line x1=\"%.2f\" y1=\"%.2f\" x2=\"%.2f\" y2=\"%.2f\" stroke=\"black\"/>\n", x1, y1, x2, y2)
+	}
+	c.drawPlanes(node.Left, clipPolygon(cell, node, true))
+	c.drawPlanes(node.Right, clipPolygon(cell, node, false))
+}
+
+// WriteTreeSVG draws 2D vectors colored by their leaf and the planes of the chosen tree,
+// it's meant for debugging on the small demo datasets
+func (lsh *LSHIndex) WriteTreeSVG(w io.Writer, perm int, vecs [][]float64) error {
+	trees := lsh.hasher.exportTrees()
+	if perm < 0 || perm >= len(trees) || trees[perm] == nil {
+		return treeIndexErr
+	}
+	if len(vecs) == 0 {
+		return svgEmptyVectorErr
+	}
+	c := &svgCanvas{
+		w:    bufio.NewWriter(w),
+		minX: math.MaxFloat64, minY: math.MaxFloat64,
+		maxX: -math.MaxFloat64, maxY: -math.MaxFloat64,
+	}
+	for _, v := range vecs {
+		if len(v) != 2 {
+			return svgDimensionsErr
+		}
+		c.minX, c.maxX = math.Min(c.minX, v[0]), math.Max(c.maxX, v[0])
+		c.minY, c.maxY = math.Min(c.minY, v[1]), math.Max(c.maxY, v[1])
+	}
+	marginX := math.Max((c.maxX-c.minX)*svgMargin, tol)
+	marginY := math.Max((c.maxY-c.minY)*svgMargin, tol)
+	c.minX, c.maxX = c.minX-marginX, c.maxX+marginX
+	c.minY, c.maxY = c.minY-marginY, c.maxY+marginY
+
+	fmt.Fprintf(c.w, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%v\" height=\"%v\">\n", svgSize, svgSize)
+	box := []point2D{{c.minX, c.minY}, {c.maxX, c.minY}, {c.maxX, c.maxY}, {c.minX, c.maxY}}
+	c.drawPlanes(trees[perm], box)
+
+	for _, v := range vecs {
+		leafID := lsh.hasher.getHashes(v)[perm]
+		hue := (leafID * 137) % 360
+		x, y := c.toPicture(point2D{v[0], v[1]})
+		fmt.Fprintf(c.w, "  <circle cx=\"%.2f\" cy=\"%.2f\" r=\"%v\" fill=\"hsl(%v,70%%,45%%)\"><title>leaf %v</title></circle>\n", x, y, svgPointSize, hue, leafID)
+	}
+	fmt.Fprintln(c.w, "</svg>")
+	return c.w.Flush()
+}
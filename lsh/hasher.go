@@ -7,10 +7,17 @@ import (
 	"gonum.org/v1/gonum/blas/blas64"
 	"math"
 	"math/rand"
+	"runtime"
+	"sort"
 	"sync"
 	"time"
 )
 
+const (
+	// NOTE: with the less number of trees the hashing is cheaper than starting goroutines
+	parallelHashingMinTrees = 64
+)
+
 var (
 	dimensionsNumberErr     = errors.New("dimensions number must be a positive integer")
 	hasherEmptyInstancesErr = errors.New("hasher must contain at least one instance")
@@ -30,39 +37,113 @@ func (p *plane) getProductSign(vec blas64.Vector) bool {
 
 // treeNode holds binary tree with generated planes
 type treeNode struct {
-	left  *treeNode
-	right *treeNode
-	plane *plane
+	left   *treeNode
+	right  *treeNode
+	plane  *plane
+	size   int
+	leafID uint64
 }
 
-func traverse(node *treeNode, hash uint64, inpVec blas64.Vector, depth int) uint64 {
-	if node == nil || node.plane == nil {
-		return hash
+// enumerateLeaves numbers leaves in depth-first order, so leaves of every subtree get a contiguous range,
+// and returns the next free leaf id
+func enumerateLeaves(node *treeNode, next uint64) uint64 {
+	if node.plane == nil {
+		node.leafID = next
+		return next + 1
+	}
+	next = enumerateLeaves(node.left, next)
+	return enumerateLeaves(node.right, next)
+}
+
+func traverse(node *treeNode, inpVec blas64.Vector) uint64 {
+	if node == nil {
+		return 0
+	}
+	if node.plane == nil {
+		return node.leafID
 	}
-	// vec := NewVec(make([]float64, inpVec.N))
-	// blas64.Copy(inpVec, vec)
 	prodSign := node.plane.getProductSign(inpVec)
 	if !prodSign {
-		return traverse(node.right, hash, inpVec, depth+1)
+		return traverse(node.right, inpVec)
 
 	}
-	hash |= (1 << depth)
-	return traverse(node.left, hash, inpVec, depth+1)
+	return traverse(node.left, inpVec)
 }
 
-// getHash calculates LSH code
+// getHash calculates LSH code, which is the id of the leaf where the vector falls
 func (node *treeNode) getHash(vec blas64.Vector) uint64 {
-	var hash uint64
-	return traverse(node, hash, vec, 0)
+	return traverse(node, vec)
+}
+
+// probe returns the leaf of the vector and the neighbor leaf, where the vector falls
+// in the sibling subtree of its leaf; neighbor is the leaf itself for the single leaf tree
+func (node *treeNode) probe(vec blas64.Vector) (uint64, uint64) {
+	if node == nil {
+		return 0, 0
+	}
+	var sibling *treeNode
+	for node.plane != nil {
+		if node.plane.getProductSign(vec) {
+			sibling, node = node.right, node.left
+		} else {
+			sibling, node = node.left, node.right
+		}
+	}
+	if sibling == nil {
+		return node.leafID, node.leafID
+	}
+	return node.leafID, traverse(sibling, vec)
+}
+
+// SplitStrategy defines how the plane of each tree node is placed
+type SplitStrategy int
+
+const (
+	// SplitMidpoint places the plane halfway between two random points
+	SplitMidpoint SplitStrategy = iota
+	// SplitMedian orients the plane by two random points and shifts it
+	// to the median of the projections, so both sides get the same number of points
+	SplitMedian
+	// SplitCentroid places the plane with a random normal through the centroid of the points
+	SplitCentroid
+)
+
+func (s SplitStrategy) String() string {
+	switch s {
+	case SplitMidpoint:
+		return "midpoint"
+	case SplitMedian:
+		return "median"
+	case SplitCentroid:
+		return "centroid"
+	}
+	return "unknown"
 }
 
 type HasherConfig struct {
 	NTrees          int
 	KMinVecs        int
 	Dims            int
+	Split           SplitStrategy
 	isAngularMetric bool
 }
 
+// TreeStats holds the shape of a single built tree and the state of its buckets in the store
+type TreeStats struct {
+	Split       SplitStrategy
+	Depth       int
+	Leaves      int
+	MinLeafSize int
+	MaxLeafSize int
+	// NOTE: fields below are filled from the store
+	BucketEntries   int
+	EmptyBuckets    int
+	OverfullBuckets int
+	// SizeHistogram holds number of buckets by size: 0-th bin counts empty buckets,
+	// and i-th bin counts buckets with size in [2^(i-1), 2^i)
+	SizeHistogram []int
+}
+
 // Hasher holds N_PERMUTS number of trees
 type Hasher struct {
 	mutex  sync.RWMutex
@@ -77,12 +158,6 @@ func NewHasher(config HasherConfig) *Hasher {
 	}
 }
 
-// SafeHashesHolder allows to lock map while write values in it
-type safeHashesHolder struct {
-	sync.Mutex
-	v map[int]uint64
-}
-
 // planeByPoints generates random coefficients of a plane by given pair of points
 func planeByPoints(points []blas64.Vector, ndims int) *plane {
 	planeCoefs := &plane{}
@@ -133,12 +208,53 @@ func getRandomPlane(vecs [][]float64, isAngular bool) *plane {
 	return planeByPoints(randVecs, ndims)
 }
 
+// medianPlane shifts the random plane to the median of the points projections
+func medianPlane(vecs [][]float64, isAngular bool) *plane {
+	p := getRandomPlane(vecs, isAngular)
+	projections := make([]float64, len(vecs))
+	for i, v := range vecs {
+		projections[i] = blas64.Dot(NewVec(v), p.n)
+	}
+	sort.Float64s(projections)
+	p.d = projections[len(projections)/2]
+	return p
+}
+
+// centroidPlane generates plane with the random normal which goes through the centroid of the points
+func centroidPlane(vecs [][]float64) *plane {
+	ndims := len(vecs[0])
+	centroid := NewVec(make([]float64, ndims))
+	for _, v := range vecs {
+		blas64.Axpy(1/float64(len(vecs)), NewVec(v), centroid)
+	}
+	normal := NewVec(make([]float64, ndims))
+	for i := range normal.Data {
+		normal.Data[i] = rand.NormFloat64()
+	}
+	return &plane{
+		n: normal,
+		d: blas64.Dot(centroid, normal),
+	}
+}
+
+// getPlane generates plane for the node according to the chosen split strategy
+func getPlane(vecs [][]float64, config HasherConfig) *plane {
+	switch config.Split {
+	case SplitMedian:
+		return medianPlane(vecs, config.isAngularMetric)
+	case SplitCentroid:
+		return centroidPlane(vecs)
+	}
+	return getRandomPlane(vecs, config.isAngularMetric)
+}
+
 // growTree ...
 func growTree(vecs [][]float64, node *treeNode, depth int, config HasherConfig) {
-	if depth > 63 || len(vecs) < 2 { // NOTE: depth <= 63 since we will use 8 byte int to store a hash
+	node.size = len(vecs)
+	if len(vecs) < 2 {
 		return
 	}
-	node.plane = getRandomPlane(vecs, config.isAngularMetric)
+	node.plane = getPlane(vecs, config)
 	var l, r [][]float64
 	for _, v := range vecs {
 		inpVec := NewVec(v)
@@ -149,103 +265,257 @@ func growTree(vecs [][]float64, node *treeNode, depth int, config HasherConfig)
 		}
 		l = append(l, v)
 	}
+	// NOTE: plane can't separate points (e.g. duplicates), so the node stays a leaf
+	if len(l) == 0 || len(r) == 0 {
+		node.plane = nil
+		return
+	}
 	depth++
+	node.right = &treeNode{size: len(r)}
 	if len(r) > config.KMinVecs {
-		node.right = &treeNode{}
 		growTree(r, node.right, depth, config)
 	}
+	node.left = &treeNode{size: len(l)}
 	if len(l) > config.KMinVecs {
-		node.left = &treeNode{}
 		growTree(l, node.left, depth, config)
 	}
 }
 
+// stats walks the tree and collects its depth and leaves sizes
+func (node *treeNode) stats(depth int, s *TreeStats) {
+	if node.plane == nil {
+		if depth > s.Depth {
+			s.Depth = depth
+		}
+		if s.Leaves == 0 || node.size < s.MinLeafSize {
+			s.MinLeafSize = node.size
+		}
+		if node.size > s.MaxLeafSize {
+			s.MaxLeafSize = node.size
+		}
+		s.Leaves++
+		return
+	}
+	node.left.stats(depth+1, s)
+	node.right.stats(depth+1, s)
+}
+
 // buildTree creates set of planes which will be used to calculate hash
 func buildTree(vecs [][]float64, config HasherConfig) *treeNode {
 	rand.Seed(time.Now().UnixNano())
 	tree := &treeNode{}
 	growTree(vecs, tree, 0, config)
+	enumerateLeaves(tree, 0)
 	return tree
 }
 
+// normalize returns copy of the vector scaled to the unit length, zero vector is copied as is
+func normalize(inpVec []float64) blas64.Vector {
+	vec := NewVec(make([]float64, len(inpVec)))
+	copy(vec.Data, inpVec)
+	norm := blas64.Nrm2(vec)
+	if norm > tol {
+		blas64.Scal(1/norm, vec)
+	}
+	return vec
+}
+
 // build method creates the hasher instances
 func (hasher *Hasher) build(vecs [][]float64) {
 	hasher.mutex.Lock()
 	defer hasher.mutex.Unlock()
 
+	// NOTE: hashes of the angular metric are computed on the normalized vectors,
+	// so planes must be placed in the same space
+	if hasher.Config.isAngularMetric {
+		normed := make([][]float64, len(vecs))
+		for i, vec := range vecs {
+			normed[i] = normalize(vec).Data
+		}
+		vecs = normed
+	}
 	trees := make([]*treeNode, hasher.Config.NTrees)
 	wg := sync.WaitGroup{}
 	wg.Add(len(trees))
 	for i := 0; i < hasher.Config.NTrees; i++ {
 		go func(i int, wg *sync.WaitGroup) {
 			defer wg.Done()
-			tmpTree := buildTree(vecs, hasher.Config)
-			trees[i] = tmpTree
+			trees[i] = buildTree(vecs, hasher.Config)
 		}(i, &wg)
 	}
 	wg.Wait()
 	hasher.trees = trees
 }
 
-// getHashes returns map of calculated lsh values for a given vector
-func (hasher *Hasher) getHashes(inpVec []float64) map[int]uint64 {
+// stats returns shape statistics of every built tree
+func (hasher *Hasher) stats() []TreeStats {
 	hasher.mutex.RLock()
 	defer hasher.mutex.RUnlock()
 
-	vec := NewVec(make([]float64, len(inpVec)))
-	copy(vec.Data, inpVec)
+	stats := make([]TreeStats, len(hasher.trees))
+	for i, tree := range hasher.trees {
+		stats[i].Split = hasher.Config.Split
+		if tree != nil {
+			tree.stats(0, &stats[i])
+		}
+	}
+	return stats
+}
+
+// hashTrees fills hashes of the vector calculated by every tree, and the neighbor leaves, when they are requested
+func hashTrees(trees []*treeNode, vec blas64.Vector, hashes, neighbors []uint64) {
+	for i, tree := range trees {
+		if neighbors == nil {
+			hashes[i] = tree.getHash(vec)
+			continue
+		}
+		hashes[i], neighbors[i] = tree.probe(vec)
+	}
+}
+
+// computeHashes calculates lsh values splitting trees between the given number of workers;
+// neighbors are nil unless withNeighbors is set
+func (hasher *Hasher) computeHashes(inpVec []float64, workers int, withNeighbors bool) ([]uint64, []uint64) {
+	hasher.mutex.RLock()
+	defer hasher.mutex.RUnlock()
+
+	var vec blas64.Vector
 	// NOTE: norm vector when using angular matric (since normed vectors has been used for planes generation in this case)
 	if hasher.Config.isAngularMetric {
-		normed := NewVec(make([]float64, len(inpVec)))
-		norm := blas64.Nrm2(vec)
-		if norm > tol {
-			blas64.Axpy(1/norm, vec, normed)
-			blas64.Copy(normed, vec)
-		}
+		vec = normalize(inpVec)
+	} else {
+		vec = NewVec(make([]float64, len(inpVec)))
+		copy(vec.Data, inpVec)
+	}
+	hashes := make([]uint64, len(hasher.trees))
+	var neighbors []uint64
+	if withNeighbors {
+		neighbors = make([]uint64, len(hasher.trees))
 	}
-	hashes := &safeHashesHolder{v: make(map[int]uint64)}
+	if workers <= 1 {
+		hashTrees(hasher.trees, vec, hashes, neighbors)
+		return hashes, neighbors
+	}
+	chunkSize := (len(hasher.trees) + workers - 1) / workers
 	wg := sync.WaitGroup{}
-	wg.Add(len(hasher.trees))
-	for i, tree := range hasher.trees {
-		go func(i int, tree *treeNode, hashes *safeHashesHolder) {
+	for start := 0; start < len(hasher.trees); start += chunkSize {
+		end := start + chunkSize
+		if end > len(hasher.trees) {
+			end = len(hasher.trees)
+		}
+		wg.Add(1)
+		go func(start, end int) {
 			defer wg.Done()
-			hashes.Lock()
-			hashes.v[i] = tree.getHash(vec)
-			hashes.Unlock()
-		}(i, tree, hashes)
+			if neighbors == nil {
+				hashTrees(hasher.trees[start:end], vec, hashes[start:end], nil)
+				return
+			}
+			hashTrees(hasher.trees[start:end], vec, hashes[start:end], neighbors[start:end])
+		}(start, end)
 	}
 	wg.Wait()
-	return hashes.v
+	return hashes, neighbors
 }
 
-// dump encodes Hasher object as a byte-array
-func (hasher *Hasher) dump() ([]byte, error) {
+// workers returns number of hashing workers: trees are traversed sequentially
+// or by the pool of GOMAXPROCS workers for the large number of trees
+func (hasher *Hasher) workers() int {
+	hasher.mutex.RLock()
+	nTrees := len(hasher.trees)
+	hasher.mutex.RUnlock()
+
+	if nTrees >= parallelHashingMinTrees {
+		return runtime.GOMAXPROCS(0)
+	}
+	return 1
+}
+
+// getHashes returns lsh values for a given vector, indexed by tree
+func (hasher *Hasher) getHashes(inpVec []float64) []uint64 {
+	hashes, _ := hasher.computeHashes(inpVec, hasher.workers(), false)
+	return hashes
+}
+
+// getProbes returns lsh values for a given vector and the neighbor leaves to probe, indexed by tree
+func (hasher *Hasher) getProbes(inpVec []float64) ([]uint64, []uint64) {
+	return hasher.computeHashes(inpVec, hasher.workers(), true)
+}
+
+// hasherDump is a serializable form of the Hasher, since trees are kept in unexported fields
+type hasherDump struct {
+	Config HasherConfig
+	Trees  []*ExportedNode
+	// NOTE: ids mapping is dumped with the hasher, so internal ids survive reloading
+	IDs  []string
+	UIDs []uint64
+}
+
+func importNode(node *ExportedNode) *treeNode {
+	if node == nil {
+		return nil
+	}
+	imported := &treeNode{size: node.Size}
+	if node.IsLeaf {
+		return imported
+	}
+	imported.plane = &plane{n: NewVec(node.Normal), d: node.Offset}
+	imported.left = importNode(node.Left)
+	imported.right = importNode(node.Right)
+	return imported
+}
+
+// dump encodes Hasher object and the ids mapping as a byte-array
+func (hasher *Hasher) dump(mapping *idMapping) ([]byte, error) {
 	hasher.mutex.RLock()
 	defer hasher.mutex.RUnlock()
 
 	if len(hasher.trees) == 0 {
 		return nil, hasherEmptyInstancesErr
 	}
+	dumped := hasherDump{
+		Config: hasher.Config,
+		Trees:  make([]*ExportedNode, len(hasher.trees)),
+		IDs:    mapping.names,
+		UIDs:   mapping.uids,
+	}
+	for i, tree := range hasher.trees {
+		dumped.Trees[i] = exportNode(tree)
+	}
 	buf := &bytes.Buffer{}
 	enc := gob.NewEncoder(buf)
-	err := enc.Encode(hasher)
+	err := enc.Encode(dumped)
 	if err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
 }
 
-// load loads Hasher struct from the byte-array file
-func (hasher *Hasher) load(inp []byte) error {
-	hasher.mutex.Lock()
-	defer hasher.mutex.Unlock()
-
-	buf := &bytes.Buffer{}
-	buf.Write(inp)
-	dec := gob.NewDecoder(buf)
-	err := dec.Decode(&hasher)
+// load loads Hasher struct from the byte-array file and returns the dumped ids mapping,
+// leaf ids are enumerated again
+func (hasher *Hasher) load(inp []byte) (*idMapping, error) {
+	dumped := hasherDump{}
+	dec := gob.NewDecoder(bytes.NewReader(inp))
+	err := dec.Decode(&dumped)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	mapping, err := newIDMapping(dumped.IDs, dumped.UIDs)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	trees := make([]*treeNode, len(dumped.Trees))
+	for i, tree := range dumped.Trees {
+		trees[i] = importNode(tree)
+		if trees[i] != nil {
+			enumerateLeaves(trees[i], 0)
+		}
+	}
+
+	hasher.mutex.Lock()
+	defer hasher.mutex.Unlock()
+	// NOTE: metric type isn't exported, so it's kept from the index config
+	dumped.Config.isAngularMetric = hasher.Config.isAngularMetric
+	hasher.Config = dumped.Config
+	hasher.trees = trees
+	return mapping, nil
 }
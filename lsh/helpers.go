@@ -2,7 +2,6 @@ package lsh
 
 import (
 	"errors"
-	"fmt"
 	"gonum.org/v1/gonum/blas/blas64"
 	"gonum.org/v1/gonum/mat"
 	"math"
@@ -274,7 +273,3 @@ func (s *StringSet) Remove(key string) {
 	defer s.mx.Unlock()
 	delete(s.Items, key)
 }
-
-func getBucketName(perm int, hash uint64) string {
-	return fmt.Sprintf("%v_%v", perm, hash)
-}
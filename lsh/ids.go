@@ -0,0 +1,77 @@
+package lsh
+
+import (
+	"errors"
+	"strconv"
+)
+
+var (
+	idsLengthErr   = errors.New("Number of ids must be equal to the number of vectors")
+	idsOverflowErr = errors.New("Number of vectors exceeds uint32 range")
+	duplicateIDErr = errors.New("Ids must be unique")
+)
+
+// idMapping holds bidirectional mapping between user ids and dense internal ones;
+// it's immutable after creation, so it's shared by searches without locking
+type idMapping struct {
+	ids   map[string]uint32
+	names []string
+	// NOTE: uids is nil unless the index was trained with uint64 ids
+	uids []uint64
+}
+
+// newIDMapping assigns internal ids in the order of the training set;
+// NOTE: ids are copied, so the caller could reuse its slices after training
+func newIDMapping(ids []string, uids []uint64) (*idMapping, error) {
+	if uint64(len(ids)) > uint64(^uint32(0)) {
+		return nil, idsOverflowErr
+	}
+	m := &idMapping{
+		ids:   make(map[string]uint32, len(ids)),
+		names: append([]string(nil), ids...),
+	}
+	if uids != nil {
+		m.uids = append([]uint64(nil), uids...)
+	}
+	for i, id := range ids {
+		if _, ok := m.ids[id]; ok {
+			return nil, duplicateIDErr
+		}
+		m.ids[id] = uint32(i)
+	}
+	return m, nil
+}
+
+func (m *idMapping) size() int {
+	return len(m.names)
+}
+
+func (m *idMapping) internal(id string) (uint32, bool) {
+	internal, ok := m.ids[id]
+	return internal, ok
+}
+
+func (m *idMapping) external(internal uint32) (string, bool) {
+	if int(internal) >= len(m.names) {
+		return "", false
+	}
+	return m.names[internal], true
+}
+
+// uid returns user uint64 id, if the index was trained with them
+func (m *idMapping) uid(id string) (uint64, bool) {
+	internal, ok := m.ids[id]
+	if !ok || m.uids == nil {
+		return 0, false
+	}
+	return m.uids[internal], true
+}
+
+// formatUIDs converts uint64 ids to the string ones, which are used as the store keys
+func formatUIDs(uids []uint64) []string {
+	ids := make([]string, len(uids))
+	for i, uid := range uids {
+		ids[i] = strconv.FormatUint(uid, 10)
+	}
+	return ids
+}
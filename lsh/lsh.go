@@ -2,14 +2,16 @@ package lsh
 
 import (
 	"container/heap"
+	"context"
 	"errors"
 	"github.com/gasparian/lsh-search-go/store"
-	"math"
+	"math/bits"
 	"sync"
 )
 
 var (
-	DistanceErr = errors.New("Distance can't be calculated")
+	DistanceErr  = errors.New("Distance can't be calculated")
+	codeStoreErr = errors.New("Store must implement store.CodeStore to hold encoded vectors")
 )
 
 // Neighbor represent neighbor vector with distance to the query vector
@@ -17,6 +19,8 @@ type Neighbor struct {
 	Vec  []float64
 	ID   string
 	Dist float64
+	// UID is filled when the index was trained with uint64 ids
+	UID uint64
 }
 
 type NeighborMinHeap []*Neighbor
@@ -58,11 +62,23 @@ type Indexer interface {
 	Search(query []float64, maxNN int, distanceThrsh float64) ([]Neighbor, error)
 }
 
+// VectorSource provides exact vectors for the re-ranking stage of the search
+type VectorSource interface {
+	GetVector(ctx context.Context, id string) ([]float64, error)
+}
+
 // IndexConfig ...
 type IndexConfig struct {
 	mx            *sync.RWMutex
 	BatchSize     int
 	MaxCandidates int
+	// RerankTop is a number of the closest candidates which are re-ranked
+	// by the exact vectors from ExactVectors; re-ranking is disabled when ExactVectors is nil.
+	// NOTE: at least maxNN candidates are re-ranked, so zero value re-ranks maxNN of them
+	RerankTop    int
+	ExactVectors VectorSource
+	// Codec compresses vectors, so the store holds codes instead of the raw vectors
+	Codec VectorCodec
 }
 
 func (c *IndexConfig) getBatchSize() int {
@@ -77,6 +93,18 @@ func (c *IndexConfig) getMaxCandidates() int {
 	return c.MaxCandidates
 }
 
+func (c *IndexConfig) getRerank() (int, VectorSource) {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	return c.RerankTop, c.ExactVectors
+}
+
+func (c *IndexConfig) getCodec() VectorCodec {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	return c.Codec
+}
+
 // Config holds all needed constants for creating the Hasher instance
 type Config struct {
 	IndexConfig
@@ -85,10 +113,20 @@ type Config struct {
 
 // LSHIndex holds buckets with vectors and hasher instance
 type LSHIndex struct {
+	mx             sync.RWMutex
 	config         IndexConfig
 	index          store.Store
 	hasher         *Hasher
 	distanceMetric Metric
+	ids            *idMapping
+}
+
+// checkCodeStore verifies that store could hold codes when the codec is set
+func checkCodeStore(s store.Store, codec VectorCodec) error {
+	if _, ok := s.(store.CodeStore); codec != nil && !ok {
+		return codeStoreErr
+	}
+	return nil
 }
 
 // New creates new instance of hasher and index, where generated hashes will be stored
@@ -96,22 +134,61 @@ func NewLsh(config Config, store store.Store, metric Metric) (*LSHIndex, error)
 	config.HasherConfig.isAngularMetric = metric.IsAngular()
 	hasher := NewHasher(config.HasherConfig)
 	config.IndexConfig.mx = new(sync.RWMutex)
+	err := checkCodeStore(store, config.Codec)
+	if err != nil {
+		return nil, err
+	}
+	ids, _ := newIDMapping(nil, nil)
 	return &LSHIndex{
 		config:         config.IndexConfig,
 		hasher:         hasher,
 		index:          store,
 		distanceMetric: metric,
+		ids:            ids,
 	}, nil
 }
 
 // Train fills new search index with vectors
 func (lsh *LSHIndex) Train(vecs [][]float64, ids []string) error {
-	err := lsh.index.Clear()
+	return lsh.TrainContext(context.Background(), vecs, ids)
+}
+
+// TrainContext is Train, which passes ctx to every store call
+func (lsh *LSHIndex) TrainContext(ctx context.Context, vecs [][]float64, ids []string) error {
+	return lsh.train(ctx, vecs, ids, nil)
+}
+
+// TrainUint64 fills new search index with vectors identified by uint64 ids,
+// which are returned in Neighbor.UID; string ids are their decimal form
+func (lsh *LSHIndex) TrainUint64(vecs [][]float64, uids []uint64) error {
+	return lsh.train(context.Background(), vecs, formatUIDs(uids), uids)
+}
+
+func (lsh *LSHIndex) train(ctx context.Context, vecs [][]float64, ids []string, uids []uint64) error {
+	if len(ids) != len(vecs) {
+		return idsLengthErr
+	}
+	mapping, err := newIDMapping(ids, uids)
 	if err != nil {
 		return err
 	}
+	err = lsh.index.Clear(ctx)
+	if err != nil {
+		return err
+	}
+	lsh.mx.Lock()
+	lsh.ids = mapping
+	lsh.mx.Unlock()
 	lsh.hasher.build(vecs)
+	codec := lsh.config.getCodec()
+	if codec != nil {
+		err = codec.Train(vecs)
+		if err != nil {
+			return err
+		}
+	}
 	batchSize := lsh.config.getBatchSize()
+	errs := make(chan error, (len(vecs)+batchSize-1)/batchSize)
 	wg := sync.WaitGroup{}
 	for i := 0; i < len(vecs); i += batchSize {
 		wg.Add(1)
@@ -121,89 +198,307 @@ func (lsh *LSHIndex) Train(vecs [][]float64, ids []string) error {
 		}
 		go func(vecs [][]float64, ids []string, wg *sync.WaitGroup) {
 			defer wg.Done()
-			for i := range vecs {
-				hashes := lsh.hasher.getHashes(vecs[i])
-				lsh.index.SetVector(ids[i], vecs[i])
-				for perm, hash := range hashes {
-					bucketName := getBucketName(perm, hash)
-					lsh.index.SetHash(bucketName, ids[i])
-				}
-			}
+			errs <- lsh.trainBatch(ctx, vecs, ids, codec)
 		}(vecs[i:end], ids[i:end], &wg)
 	}
 	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// trainBatch hashes vectors and flushes the whole batch to the store
+func (lsh *LSHIndex) trainBatch(ctx context.Context, vecs [][]float64, ids []string, codec VectorCodec) error {
+	hashes := make(map[store.BucketKey][]string)
+	for i := range vecs {
+		for perm, hash := range lsh.hasher.getHashes(vecs[i]) {
+			key := store.BucketKey{Tree: perm, Hash: hash}
+			hashes[key] = append(hashes[key], ids[i])
+		}
+	}
+	err := lsh.setVectors(ctx, ids, vecs, codec)
+	if err != nil {
+		return err
+	}
+	return lsh.index.SetHashes(ctx, hashes)
+}
+
+// setVectors puts vectors or their codes to the store
+func (lsh *LSHIndex) setVectors(ctx context.Context, ids []string, vecs [][]float64, codec VectorCodec) error {
+	if codec == nil {
+		return lsh.index.SetVectors(ctx, ids, vecs)
+	}
+	codes := make([][]byte, len(vecs))
+	for i, vec := range vecs {
+		code, err := codec.Encode(vec)
+		if err != nil {
+			return err
+		}
+		codes[i] = code
+	}
+	return lsh.index.(store.CodeStore).SetCodes(ctx, ids, codes)
+}
+
+func (lsh *LSHIndex) getIDMapping() *idMapping {
+	lsh.mx.RLock()
+	defer lsh.mx.RUnlock()
+	return lsh.ids
+}
+
+// InternalID returns dense internal id assigned to the vector during training
+func (lsh *LSHIndex) InternalID(id string) (uint32, bool) {
+	return lsh.getIDMapping().internal(id)
+}
+
+// ExternalID returns user id of the vector by its internal id
+func (lsh *LSHIndex) ExternalID(internal uint32) (string, bool) {
+	return lsh.getIDMapping().external(internal)
+}
+
+// getCandidate returns stored vector (nil for encoded one) and its distance to the query
+func (lsh *LSHIndex) getCandidate(ctx context.Context, id string, query []float64, codeDist CodeDistance) ([]float64, float64, error) {
+	if codeDist == nil {
+		vec, err := lsh.index.GetVector(ctx, id)
+		if err != nil {
+			return nil, 0, err
+		}
+		return vec, lsh.distanceMetric.GetDist(vec, query), nil
+	}
+	code, err := lsh.index.(store.CodeStore).GetCode(ctx, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	return nil, codeDist(code), nil
+}
+
 // Search returns NNs for the query point
 func (lsh *LSHIndex) Search(query []float64, maxNN int, distanceThrsh float64) ([]Neighbor, error) {
+	return lsh.SearchContext(context.Background(), query, maxNN, distanceThrsh)
+}
+
+// SearchContext is Search, which stops when ctx is done;
+// missing buckets are skipped, but any other store error is returned
+func (lsh *LSHIndex) SearchContext(ctx context.Context, query []float64, maxNN int, distanceThrsh float64) ([]Neighbor, error) {
 	maxCandidates := lsh.config.getMaxCandidates()
-	hashes := lsh.hasher.getHashes(query)
+	codec := lsh.config.getCodec()
+	var codeDist CodeDistance
+	if codec != nil {
+		var err error
+		codeDist, err = codec.NewDistance(query, lsh.distanceMetric)
+		if err != nil {
+			return nil, err
+		}
+	}
+	hashes, neighbors := lsh.hasher.getProbes(query)
+	mapping := lsh.getIDMapping()
 	closestSet := make(map[string]bool)
 	minHeap := new(NeighborMinHeap)
+	// NOTE: iterator is always closed, even when search stops early on MaxCandidates
+	scanBucket := func(iter store.Iterator) error {
+		defer iter.Close()
+		for {
+			if minHeap.Len() >= maxCandidates {
+				break
+			}
+			id, opened := iter.Next()
+			if !opened {
+				break
+			}
+			if closestSet[id] {
+				continue
+			}
+			vec, dist, err := lsh.getCandidate(ctx, id, query, codeDist)
+			if err != nil {
+				return err
+			}
+			if dist <= distanceThrsh {
+				closestSet[id] = true
+				heap.Push(
+					minHeap,
+					&Neighbor{
+						ID:   id,
+						Vec:  vec,
+						Dist: dist,
+					},
+				)
+			}
+		}
+		return iter.Err()
+	}
+	// NOTE: remaining buckets are not requested at all once MaxCandidates are collected
+	scanKey := func(key store.BucketKey) error {
+		if minHeap.Len() >= maxCandidates {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		iter, err := lsh.index.GetHashIterator(ctx, key)
+		if errors.Is(err, store.BucketNotFoundErr) {
+			return nil // NOTE: it's normal when we couldn't find bucket for the query point
+		}
+		if err != nil {
+			return err
+		}
+		return scanBucket(iter)
+	}
 	for perm, hash := range hashes {
 		if minHeap.Len() >= maxCandidates {
 			break
 		}
-		// NOTE: look in the neigbors' "bucket" too
-		var neighborPos int = 0
-		if hash > 0 {
-			neighborPos = int(math.Floor(math.Log2(float64(hash))))
-		}
-		neighborHash := hash ^ (1 << neighborPos)
-		bucketsNames := []string{
-			getBucketName(perm, hash),
-			getBucketName(perm, neighborHash),
+		err := scanKey(store.BucketKey{Tree: perm, Hash: hash})
+		if err != nil {
+			return nil, err
 		}
-		for _, bucketName := range bucketsNames {
-			iter, err := lsh.index.GetHashIterator(bucketName)
+		// NOTE: look in the neighbor bucket too, where the query falls in the sibling subtree
+		if neighbors[perm] != hash {
+			err = scanKey(store.BucketKey{Tree: perm, Hash: neighbors[perm]})
 			if err != nil {
-				continue // NOTE: it's normal when we couldn't find bucket for the query point
+				return nil, err
 			}
-			for {
-				if minHeap.Len() >= maxCandidates {
-					break
-				}
-				id, opened := iter.Next()
-				if !opened {
-					break
-				}
-				if closestSet[id] {
-					continue
-				}
-				vec, err := lsh.index.GetVector(id)
-				if err != nil {
-					return nil, err
-				}
-				dist := lsh.distanceMetric.GetDist(vec, query)
-				if dist <= distanceThrsh {
-					closestSet[id] = true
-					heap.Push(
-						minHeap,
-						&Neighbor{
-							ID:   id,
-							Vec:  vec,
-							Dist: dist,
-						},
-					)
-				}
-			}
-
+		}
+	}
+	rerankTop, exactVectors := lsh.config.getRerank()
+	if exactVectors != nil {
+		if rerankTop < maxNN {
+			rerankTop = maxNN
+		}
+		var err error
+		minHeap, err = lsh.rerank(ctx, query, minHeap, rerankTop, distanceThrsh, exactVectors)
+		if err != nil {
+			return nil, err
 		}
 	}
 	closest := make([]Neighbor, 0)
 	for i := 0; i < maxNN && minHeap.Len() > 0; i++ {
 		closest = append(closest, *heap.Pop(minHeap).(*Neighbor))
 	}
+	for i := range closest {
+		closest[i].UID, _ = mapping.uid(closest[i].ID)
+	}
+	// NOTE: restore approximate vectors, when the store holds only codes
+	for i := range closest {
+		if closest[i].Vec != nil {
+			continue
+		}
+		code, err := lsh.index.(store.CodeStore).GetCode(ctx, closest[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		closest[i].Vec, err = codec.Decode(code)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return closest, nil
 }
 
-// DumpHasher serializes hasher
+// rerank recalculates distances of the top candidates using the exact vectors
+func (lsh *LSHIndex) rerank(ctx context.Context, query []float64, candidates *NeighborMinHeap, top int, distanceThrsh float64, source VectorSource) (*NeighborMinHeap, error) {
+	reranked := new(NeighborMinHeap)
+	for i := 0; i < top && candidates.Len() > 0; i++ {
+		candidate := heap.Pop(candidates).(*Neighbor)
+		vec, err := source.GetVector(ctx, candidate.ID)
+		if err != nil {
+			return nil, err
+		}
+		dist := lsh.distanceMetric.GetDist(vec, query)
+		if dist <= distanceThrsh {
+			heap.Push(
+				reranked,
+				&Neighbor{
+					ID:   candidate.ID,
+					Vec:  vec,
+					Dist: dist,
+				},
+			)
+		}
+	}
+	return reranked, nil
+}
+
+// IndexStats holds statistics of the whole index
+type IndexStats struct {
+	Trees           []TreeStats
+	Buckets         int
+	BucketEntries   int
+	EmptyBuckets    int
+	OverfullBuckets int
+}
+
+// TreeStats returns shape statistics of the hasher trees
+func (lsh *LSHIndex) TreeStats() []TreeStats {
+	return lsh.hasher.stats()
+}
+
+// Stats returns statistics of the hasher trees combined with the buckets sizes from the store
+func (lsh *LSHIndex) Stats() (*IndexStats, error) {
+	return lsh.StatsContext(context.Background())
+}
+
+// StatsContext is Stats, which passes ctx to the store
+func (lsh *LSHIndex) StatsContext(ctx context.Context) (*IndexStats, error) {
+	sizes, err := lsh.index.GetBucketsSizes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lsh.hasher.mutex.RLock()
+	kMinVecs := lsh.hasher.Config.KMinVecs
+	lsh.hasher.mutex.RUnlock()
+
+	stats := &IndexStats{
+		Trees: lsh.hasher.stats(),
+	}
+	filled := make([]int, len(stats.Trees))
+	for bucketKey, size := range sizes {
+		perm := bucketKey.Tree
+		if perm >= len(stats.Trees) || size == 0 {
+			continue
+		}
+		tree := &stats.Trees[perm]
+		tree.BucketEntries += size
+		if size > kMinVecs {
+			tree.OverfullBuckets++
+		}
+		bin := bits.Len(uint(size))
+		for len(tree.SizeHistogram) <= bin {
+			tree.SizeHistogram = append(tree.SizeHistogram, 0)
+		}
+		tree.SizeHistogram[bin]++
+		filled[perm]++
+	}
+	for i := range stats.Trees {
+		tree := &stats.Trees[i]
+		tree.EmptyBuckets = tree.Leaves - filled[i]
+		if len(tree.SizeHistogram) == 0 {
+			tree.SizeHistogram = append(tree.SizeHistogram, 0)
+		}
+		tree.SizeHistogram[0] = tree.EmptyBuckets
+		stats.Buckets += tree.Leaves
+		stats.BucketEntries += tree.BucketEntries
+		stats.EmptyBuckets += tree.EmptyBuckets
+		stats.OverfullBuckets += tree.OverfullBuckets
+	}
+	return stats, nil
+}
+
+// DumpHasher serializes hasher together with the ids mapping
 func (lsh *LSHIndex) DumpHasher() ([]byte, error) {
-	return lsh.hasher.dump()
+	return lsh.hasher.dump(lsh.getIDMapping())
 }
 
-// LoadHasher fills hasher from byte array
+// LoadHasher fills hasher and the ids mapping from byte array
 func (lsh *LSHIndex) LoadHasher(inp []byte) error {
-	return lsh.hasher.load(inp)
+	mapping, err := lsh.hasher.load(inp)
+	if err != nil {
+		return err
+	}
+	lsh.mx.Lock()
+	lsh.ids = mapping
+	lsh.mx.Unlock()
+	return nil
 }
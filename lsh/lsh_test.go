@@ -1,13 +1,24 @@
 package lsh
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
 	"github.com/gasparian/lsh-search-go/store/kv"
 	guuid "github.com/google/uuid"
 	"gonum.org/v1/gonum/blas/blas64"
 	"math"
 	"math/rand"
+	"reflect"
+	"runtime"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -34,15 +45,126 @@ func TestGetHash(t *testing.T) {
 	}
 	hasherInstance := buildTree(vecs, HasherConfig{KMinVecs: 2, isAngularMetric: false})
 	hash := hasherInstance.getHash(NewVec(vecs[0]))
+	if hash != 0 {
+		t.Fatal("Wrong hash value, must be 0")
+	}
+	hash = hasherInstance.getHash(NewVec(vecs[1]))
 	if hash != 1 {
 		t.Fatal("Wrong hash value, must be 1")
 	}
-	hash = hasherInstance.getHash(NewVec(vecs[1]))
-	if hash != 0 {
-		t.Fatal("Wrong hash value, must be 0")
+	leaf, neighbor := hasherInstance.probe(NewVec(vecs[0]))
+	if leaf != 0 || neighbor != 1 {
+		t.Fatalf("Leaves must be neighbors of each other, got %v and %v", leaf, neighbor)
 	}
 }
 
+func TestLeafIDs(t *testing.T) {
+	const depth = 100
+	root := &treeNode{}
+	node := root
+	for i := 0; i < depth; i++ {
+		node.plane = &plane{n: NewVec([]float64{1.0}), d: 1.0}
+		node.left = &treeNode{}
+		node.right = &treeNode{}
+		node = node.left
+	}
+	leaves := enumerateLeaves(root, 0)
+	if leaves != depth+1 {
+		t.Fatalf("Tree must have %v leaves, got %v", depth+1, leaves)
+	}
+	// NOTE: the deepest left leaf and the right leaf of the root
+	deepest := root.getHash(NewVec([]float64{0.0}))
+	shallow := root.getHash(NewVec([]float64{2.0}))
+	if deepest == shallow {
+		t.Fatal("Different leaves must get different ids")
+	}
+	// NOTE: neighbor of the root's right leaf is found by descending the whole left subtree
+	leaf, neighbor := root.probe(NewVec([]float64{2.0}))
+	if leaf != shallow || neighbor != shallow-1 {
+		t.Fatalf("Neighbor of the root's right leaf must be the closest leaf of the left subtree, got %v", neighbor)
+	}
+	leaf, neighbor = root.probe(NewVec([]float64{0.0}))
+	if leaf != deepest || neighbor != deepest+1 {
+		t.Fatalf("Neighbor of the deepest leaf must be the next leaf, got %v", neighbor)
+	}
+
+	vecs := make([][]float64, 100)
+	for i := range vecs {
+		vecs[i] = []float64{1.0, 1.0}
+	}
+	tree := buildTree(vecs, HasherConfig{KMinVecs: 1})
+	if tree.plane != nil {
+		t.Fatal("Tree node must stay a leaf when points can't be separated")
+	}
+}
+
+func TestSplitStrategies(t *testing.T) {
+	vecs := make([][]float64, 1000)
+	for i := range vecs {
+		// NOTE: skewed data, most of the points are packed near the origin
+		vecs[i] = []float64{math.Exp(rand.NormFloat64() * 3), rand.Float64()}
+	}
+	for _, split := range []SplitStrategy{SplitMidpoint, SplitMedian, SplitCentroid} {
+		config := HasherConfig{NTrees: 3, KMinVecs: 10, Dims: 2, Split: split}
+		hasher := NewHasher(config)
+		hasher.build(vecs)
+		for _, s := range hasher.stats() {
+			if s.Split != split {
+				t.Fatalf("Wrong split strategy in stats: expected %v, got %v", split, s.Split)
+			}
+			if s.Leaves < 2 {
+				t.Fatalf("Tree built with %v split must have several leaves, got %v", split, s.Leaves)
+			}
+			if split == SplitMedian && s.Depth > 8 {
+				t.Fatalf("Tree built with median split must be balanced, got depth %v", s.Depth)
+			}
+		}
+	}
+
+	t.Run("Angular", func(t *testing.T) {
+		const dims = 4
+		vecs := make([][]float64, 4000)
+		ids := make([]string, len(vecs))
+		for i := range vecs {
+			// NOTE: norms vary a lot, while the hashes are computed on the normalized vectors
+			norm := math.Exp(rand.NormFloat64() * 2)
+			vecs[i] = make([]float64, dims)
+			for j := range vecs[i] {
+				vecs[i][j] = rand.NormFloat64() * norm
+			}
+			ids[i] = strconv.Itoa(i)
+		}
+		for _, split := range []SplitStrategy{SplitMidpoint, SplitMedian, SplitCentroid} {
+			config := Config{
+				IndexConfig: IndexConfig{BatchSize: 500, MaxCandidates: 100},
+				HasherConfig: HasherConfig{
+					NTrees:   3,
+					KMinVecs: 50,
+					Dims:     dims,
+					Split:    split,
+				},
+			}
+			lsh, err := NewLsh(config, kv.NewKVStore(), NewAngular())
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = lsh.Train(vecs, ids)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stats, err := lsh.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, tree := range stats.Trees {
+				if tree.EmptyBuckets != 0 || tree.OverfullBuckets != 0 || tree.MaxLeafSize > config.KMinVecs {
+					t.Fatalf("Buckets built with %v split must follow the tree leaves: %+v", split, tree)
+				}
+			}
+		}
+	})
+}
+
 // TODO: fix tests according to the new cosine sim. calculation algorithm
 func TestCosineSim(t *testing.T) {
 	cosine := NewAngular()
@@ -118,7 +240,11 @@ func TestDumpHasher(t *testing.T) {
 	hasher := NewHasher(config)
 	hasher.build(vecs)
 	coefToTest := hasher.trees[0].plane.d
-	b, err := hasher.dump()
+	mapping, err := newIDMapping([]string{"a", "b"}, []uint64{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := hasher.dump(mapping)
 	if err != nil {
 		t.Fatalf("Could not serialize hasher: %v", err)
 	}
@@ -126,13 +252,32 @@ func TestDumpHasher(t *testing.T) {
 		t.Fatal("Smth went wrong serializing the hasher: resulting bytearray is empty")
 	}
 
-	err = hasher.load(b)
+	loaded := NewHasher(HasherConfig{})
+	loadedMapping, err := loaded.load(b)
 	if err != nil {
 		t.Fatalf("Could not deserialize hasher: %v", err)
 	}
-	if coefToTest != hasher.trees[0].plane.d {
+	if !reflect.DeepEqual(loadedMapping, mapping) {
+		t.Fatalf("Ids mapping differs after loading: %v", loadedMapping)
+	}
+	if coefToTest != loaded.trees[0].plane.d {
 		t.Fatal("Seems like the deserialized hasher differs from the initial one")
 	}
+	if loaded.Config != hasher.Config {
+		t.Fatalf("Config differs after loading: %v", loaded.Config)
+	}
+	for _, vec := range vecs {
+		if !reflect.DeepEqual(hasher.getHashes(vec), loaded.getHashes(vec)) {
+			t.Fatal("Loaded hasher must return the same hashes")
+		}
+	}
+	for _, vec := range vecs {
+		_, neighbors := hasher.getProbes(vec)
+		_, loadedNeighbors := loaded.getProbes(vec)
+		if !reflect.DeepEqual(neighbors, loadedNeighbors) {
+			t.Fatal("Loaded hasher must return the same neighbors")
+		}
+	}
 }
 
 func TestNewVec(t *testing.T) {
@@ -239,6 +384,79 @@ func testLSH(metric Metric, config Config, maxNN int, distanceThrsh float64, tra
 		}
 	})
 
+	t.Run("LshStats", func(t *testing.T) {
+		stats, err := lsh.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stats.Trees) != config.NTrees {
+			t.Fatalf("Expected stats for %v trees, got %v", config.NTrees, len(stats.Trees))
+		}
+		if stats.BucketEntries != config.NTrees*len(trainSet) {
+			t.Fatalf("Expected %v bucket entries, got %v", config.NTrees*len(trainSet), stats.BucketEntries)
+		}
+		for _, tree := range stats.Trees {
+			histSum := 0
+			for _, n := range tree.SizeHistogram {
+				histSum += n
+			}
+			if histSum != tree.Leaves {
+				t.Fatalf("Size histogram must cover all %v leaves, got %v", tree.Leaves, tree.SizeHistogram)
+			}
+		}
+	})
+
+	t.Run("LshExportTrees", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		err := lsh.WriteTreesJSON(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trees := make([]*ExportedNode, 0)
+		err = json.Unmarshal(buf.Bytes(), &trees)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trees) != config.NTrees || trees[0].Size != len(trainSet) {
+			t.Fatal("Exported trees differ from the built ones")
+		}
+		leaf := trees[0]
+		for !leaf.IsLeaf {
+			if leaf.LeafID != nil {
+				t.Fatal("Internal nodes must not have the leaf id")
+			}
+			leaf = leaf.Left
+		}
+		if leaf.LeafID == nil || *leaf.LeafID != 0 {
+			t.Fatal("The leftmost leaf must be exported with the zero id")
+		}
+		if !strings.Contains(buf.String(), "\"offset\"") {
+			t.Fatal("Offset of the internal nodes must be exported even if it's zero")
+		}
+
+		buf.Reset()
+		err = lsh.WriteTreesDOT(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(buf.String(), "digraph") || !strings.Contains(buf.String(), "leaf") {
+			t.Fatal("Trees must be exported as a graph with leaves")
+		}
+
+		buf.Reset()
+		err = lsh.WriteTreeSVG(buf, 0, trainSet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Count(buf.String(), "<circle") != len(trainSet) {
+			t.Fatal("Every vector must be drawn")
+		}
+		err = lsh.WriteTreeSVG(buf, config.NTrees, trainSet)
+		if err == nil {
+			t.Fatal("Drawing of non-existing tree must fail")
+		}
+	})
+
 	t.Run("LshSearch", func(t *testing.T) {
 		nns, err := lsh.Search(trainSet[0], maxNN, distanceThrsh)
 		if err != nil {
@@ -339,3 +557,563 @@ func TestLshL2(t *testing.T) {
 	metric := NewL2()
 	testLSH(metric, config, maxNN, distanceThrsh, inpVecs, trainIds, t)
 }
+
+func TestLshUint64IDs(t *testing.T) {
+	t.Parallel()
+	inpVecs, _ := getTestLSHData()
+	uids := make([]uint64, len(inpVecs))
+	for i := range uids {
+		uids[i] = uint64(1<<40 + i)
+	}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   10,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	lsh, err := NewLsh(config, kv.NewKVStore(), NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.TrainUint64(inpVecs, uids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("Mapping", func(t *testing.T) {
+		for i, uid := range uids {
+			id := strconv.FormatUint(uid, 10)
+			internal, ok := lsh.InternalID(id)
+			if !ok || internal != uint32(i) {
+				t.Fatalf("Wrong internal id for %v: %v", id, internal)
+			}
+			external, ok := lsh.ExternalID(internal)
+			if !ok || external != id {
+				t.Fatalf("Wrong external id for %v: %v", internal, external)
+			}
+		}
+		_, ok := lsh.ExternalID(uint32(len(uids)))
+		if ok {
+			t.Error("Internal id out of range must not be found")
+		}
+	})
+	t.Run("Search", func(t *testing.T) {
+		closest, err := lsh.Search(inpVecs[0], 4, 0.02)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(closest) == 0 {
+			t.Fatal("Search must return neighbors")
+		}
+		seen := make(map[uint64]bool)
+		for _, nn := range closest {
+			if nn.ID != strconv.FormatUint(nn.UID, 10) {
+				t.Errorf("UID %v doesn't match the id %v", nn.UID, nn.ID)
+			}
+			if seen[nn.UID] {
+				t.Errorf("Duplicated neighbor %v", nn.UID)
+			}
+			seen[nn.UID] = true
+		}
+	})
+	t.Run("Reload", func(t *testing.T) {
+		dumped, err := lsh.DumpHasher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reloaded, err := NewLsh(config, kv.NewKVStore(), NewL2())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = reloaded.LoadHasher(dumped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		external, ok := reloaded.ExternalID(1)
+		if !ok || external != strconv.FormatUint(uids[1], 10) {
+			t.Errorf("Ids mapping must survive reloading, got %v", external)
+		}
+		uid, _ := reloaded.getIDMapping().uid(external)
+		if uid != uids[1] {
+			t.Errorf("Uint64 ids must survive reloading, got %v", uid)
+		}
+	})
+	t.Run("WrongIDs", func(t *testing.T) {
+		err := lsh.Train(inpVecs, []string{"0"})
+		if err != idsLengthErr {
+			t.Errorf("Expected %v, got %v", idsLengthErr, err)
+		}
+		ids := make([]string, len(inpVecs))
+		err = lsh.Train(inpVecs, ids)
+		if err != duplicateIDErr {
+			t.Errorf("Expected %v, got %v", duplicateIDErr, err)
+		}
+	})
+}
+
+func TestIDMapping(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	uids := []uint64{1, 2, 3}
+	mapping, err := newIDMapping(ids, uids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("Copied", func(t *testing.T) {
+		ids[0], uids[0] = "z", 0
+		external, _ := mapping.external(0)
+		uid, _ := mapping.uid("a")
+		if external != "a" || uid != 1 {
+			t.Errorf("Mapping must not depend on the caller slices, got %v, %v", external, uid)
+		}
+	})
+}
+
+// roundingStore imitates store with the lossy compressed vectors
+type roundingStore struct {
+	*kv.KVStore
+}
+
+func (s roundingStore) GetVector(ctx context.Context, id string) ([]float64, error) {
+	vec, err := s.KVStore.GetVector(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	rounded := make([]float64, len(vec))
+	for i, v := range vec {
+		rounded[i] = math.Round(v*10) / 10
+	}
+	return rounded, nil
+}
+
+func TestLshRerank(t *testing.T) {
+	t.Parallel()
+	const (
+		distanceThrsh = 0.2
+		maxNN         = 4
+	)
+	inpVecs, trainIds := getTestLSHData()
+	ctx := context.Background()
+	exact := kv.NewKVStore()
+	for i, vec := range inpVecs {
+		exact.SetVector(ctx, trainIds[i], vec)
+	}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+			RerankTop:     maxNN,
+			ExactVectors:  exact,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   10,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	metric := NewL2()
+	lsh, err := NewLsh(config, roundingStore{kv.NewKVStore()}, metric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nns, err := lsh.Search(inpVecs[1], maxNN, distanceThrsh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nns) == 0 || nns[0].ID != trainIds[1] || nns[0].Dist != 0.0 {
+		t.Fatalf("Query point must be the closest one after re-ranking, got %v", nns)
+	}
+	for _, nn := range nns {
+		exactVec, _ := exact.GetVector(ctx, nn.ID)
+		if math.Abs(metric.GetDist(exactVec, inpVecs[1])-nn.Dist) > tol {
+			t.Fatalf("Distance must be calculated on the exact vector, got %v", nn)
+		}
+	}
+
+	t.Run("RerankTop", func(t *testing.T) {
+		lsh.config.ExactVectors = nil
+		expected, err := lsh.Search(inpVecs[1], maxNN, 10.0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lsh.config.ExactVectors = exact
+		for _, top := range []int{0, 1} {
+			lsh.config.RerankTop = top
+			nns, err := lsh.Search(inpVecs[1], maxNN, 10.0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(nns) == 0 || len(nns) != len(expected) {
+				t.Errorf("RerankTop %v must not limit the number of neighbors, got %v", top, nns)
+			}
+		}
+	})
+}
+
+func TestProductQuantizer(t *testing.T) {
+	vecs := make([][]float64, 1000)
+	for i := range vecs {
+		vecs[i] = make([]float64, 8)
+		for j := range vecs[i] {
+			vecs[i][j] = rand.NormFloat64()
+		}
+	}
+	pq := NewProductQuantizer(4, 10, 500)
+	_, err := pq.Encode(vecs[0])
+	if err == nil {
+		t.Fatal("Untrained codec must not encode vectors")
+	}
+	err = pq.Train(vecs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := pq.Encode(vecs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != pq.CodeSize() {
+		t.Fatalf("Code must take %v bytes, got %v", pq.CodeSize(), len(code))
+	}
+	decoded, err := pq.Decode(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(vecs[0]) {
+		t.Fatal("Decoded vector must have the same dimensionality")
+	}
+	for _, metric := range []Metric{NewL2(), NewAngular()} {
+		codeDist, err := pq.NewDistance(vecs[1], metric)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(codeDist(code)-metric.GetDist(decoded, vecs[1])) > tol {
+			t.Fatal("Distance by lookup tables must be equal to the distance to the decoded vector")
+		}
+	}
+}
+
+func TestLshL2ProductQuantization(t *testing.T) {
+	t.Parallel()
+	const (
+		distanceThrsh = 0.02
+		maxNN         = 4
+	)
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+			Codec:         NewProductQuantizer(2, 5, 0),
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   10,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	metric := NewL2()
+	testLSH(metric, config, maxNN, distanceThrsh, inpVecs, trainIds, t)
+}
+
+func TestScalarQuantizer(t *testing.T) {
+	vecs := make([][]float64, 1000)
+	for i := range vecs {
+		vecs[i] = []float64{rand.NormFloat64(), rand.Float64() * 10, 1.0}
+	}
+	for _, sq := range []*ScalarQuantizer{NewScalarQuantizer(), NewStdScalarQuantizer(500, 3)} {
+		err := sq.Train(vecs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, err := sq.Encode(vecs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(code) != sq.CodeSize() {
+			t.Fatalf("Code must take %v bytes, got %v", sq.CodeSize(), len(code))
+		}
+		decoded, err := sq.Decode(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, metric := range []Metric{NewL2(), NewAngular()} {
+			codeDist, err := sq.NewDistance(vecs[1], metric)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(codeDist(code)-metric.GetDist(decoded, vecs[1])) > tol {
+				t.Fatal("Distance on codes must be equal to the distance to the decoded vector")
+			}
+		}
+	}
+	sq := NewScalarQuantizer()
+	sq.Train(vecs)
+	code, _ := sq.Encode(vecs[0])
+	decoded, _ := sq.Decode(code)
+	for j := range decoded {
+		if math.Abs(decoded[j]-vecs[0][j]) > sq.scale[j] {
+			t.Fatalf("Quantization error must not exceed the scale, got %v and %v", decoded, vecs[0])
+		}
+	}
+}
+
+func TestLshCosineScalarQuantization(t *testing.T) {
+	t.Parallel()
+	const (
+		distanceThrsh = 0.2
+		maxNN         = 4
+	)
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 10,
+			Codec:         NewScalarQuantizer(),
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   10,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	metric := NewAngular()
+	testLSH(metric, config, maxNN, distanceThrsh, inpVecs, trainIds, t)
+}
+
+// getHashesPerTreeGoroutine is the former hashing approach: goroutine per tree and a locked map
+func getHashesPerTreeGoroutine(hasher *Hasher, vec []float64) map[int]uint64 {
+	mx := sync.Mutex{}
+	hashes := make(map[int]uint64)
+	inpVec := NewVec(vec)
+	wg := sync.WaitGroup{}
+	wg.Add(len(hasher.trees))
+	for i, tree := range hasher.trees {
+		go func(i int, tree *treeNode) {
+			defer wg.Done()
+			hash := tree.getHash(inpVec)
+			mx.Lock()
+			hashes[i] = hash
+			mx.Unlock()
+		}(i, tree)
+	}
+	wg.Wait()
+	return hashes
+}
+
+func BenchmarkGetHashes(b *testing.B) {
+	const dims = 128
+	vecs := make([][]float64, 10000)
+	for i := range vecs {
+		vecs[i] = make([]float64, dims)
+		for j := range vecs[i] {
+			vecs[i][j] = rand.NormFloat64()
+		}
+	}
+	for _, nTrees := range []int{10, 100, 200} {
+		hasher := NewHasher(HasherConfig{NTrees: nTrees, KMinVecs: 100, Dims: dims})
+		hasher.build(vecs)
+		b.Run(fmt.Sprintf("GoroutinePerTree-%v", nTrees), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				getHashesPerTreeGoroutine(hasher, vecs[i%len(vecs)])
+			}
+		})
+		b.Run(fmt.Sprintf("Sequential-%v", nTrees), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				hasher.computeHashes(vecs[i%len(vecs)], 1, false)
+			}
+		})
+		b.Run(fmt.Sprintf("WorkerPool-%v", nTrees), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				hasher.computeHashes(vecs[i%len(vecs)], runtime.GOMAXPROCS(0), false)
+			}
+		})
+	}
+}
+
+// iteratorsCountingStore tracks number of opened iterators and bucket lookups
+type iteratorsCountingStore struct {
+	*kv.KVStore
+	opened int64
+	calls  int64
+}
+
+type countingIterator struct {
+	store.Iterator
+	s *iteratorsCountingStore
+}
+
+func (it countingIterator) Close() error {
+	atomic.AddInt64(&it.s.opened, -1)
+	return it.Iterator.Close()
+}
+
+func (s *iteratorsCountingStore) GetHashIterator(ctx context.Context, key store.BucketKey) (store.Iterator, error) {
+	atomic.AddInt64(&s.calls, 1)
+	it, err := s.KVStore.GetHashIterator(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&s.opened, 1)
+	return countingIterator{Iterator: it, s: s}, nil
+}
+
+func TestLshClosesIterators(t *testing.T) {
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 1,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   10,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	s := &iteratorsCountingStore{KVStore: kv.NewKVStore()}
+	lsh, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = lsh.Search(inpVecs[0], 4, 1.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened := atomic.LoadInt64(&s.opened); opened != 0 {
+		t.Fatalf("All iterators must be closed after search, %v left opened", opened)
+	}
+	// NOTE: query is the training point, so its own bucket already fills MaxCandidates
+	if calls := atomic.LoadInt64(&s.calls); calls != 1 {
+		t.Fatalf("Search must stop requesting buckets on MaxCandidates, got %v calls", calls)
+	}
+}
+
+func TestLshProbes(t *testing.T) {
+	const (
+		dims   = 4
+		nTrees = 5
+	)
+	vecs := make([][]float64, 1000)
+	ids := make([]string, len(vecs))
+	for i := range vecs {
+		vecs[i] = make([]float64, dims)
+		for j := range vecs[i] {
+			vecs[i][j] = rand.NormFloat64()
+		}
+		ids[i] = strconv.Itoa(i)
+	}
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     100,
+			MaxCandidates: len(vecs),
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   nTrees,
+			KMinVecs: 5,
+			Dims:     dims,
+		},
+	}
+	s := &iteratorsCountingStore{KVStore: kv.NewKVStore()}
+	lsh, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(vecs, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range vecs[:20] {
+		atomic.StoreInt64(&s.calls, 0)
+		_, err = lsh.Search(query, 10, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// NOTE: query leaf and a single neighbor leaf are probed in every tree, whatever the tree shape
+		if calls := atomic.LoadInt64(&s.calls); calls > 2*nTrees {
+			t.Fatalf("Search must probe at most %v buckets, got %v", 2*nTrees, calls)
+		}
+	}
+}
+
+// failingStore fails every bucket lookup with the backend error
+type failingStore struct {
+	*kv.KVStore
+	fail bool
+}
+
+var backendErr = errors.New("Backend is unavailable")
+
+func (s *failingStore) GetHashIterator(ctx context.Context, key store.BucketKey) (store.Iterator, error) {
+	if s.fail {
+		return nil, backendErr
+	}
+	return s.KVStore.GetHashIterator(ctx, key)
+}
+
+func TestLshSearchErrors(t *testing.T) {
+	inpVecs, trainIds := getTestLSHData()
+	config := Config{
+		IndexConfig: IndexConfig{
+			BatchSize:     2,
+			MaxCandidates: 4,
+		},
+		HasherConfig: HasherConfig{
+			NTrees:   10,
+			KMinVecs: 2,
+			Dims:     2,
+		},
+	}
+	s := &failingStore{KVStore: kv.NewKVStore()}
+	lsh, err := NewLsh(config, s, NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lsh.Train(inpVecs, trainIds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("MissingBucket", func(t *testing.T) {
+		// NOTE: every bucket is missing in the empty store
+		err := s.KVStore.Clear(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		closest, err := lsh.Search(inpVecs[0], 4, 1.0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(closest) != 0 {
+			t.Errorf("Empty store must return no neighbors, got: %v", closest)
+		}
+	})
+
+	t.Run("BackendError", func(t *testing.T) {
+		s.fail = true
+		defer func() { s.fail = false }()
+		_, err := lsh.Search(inpVecs[0], 4, 1.0)
+		if !errors.Is(err, backendErr) {
+			t.Errorf("Search must return the store error, got: %v", err)
+		}
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := lsh.SearchContext(ctx, inpVecs[0], 4, 1.0)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Search must stop on the canceled context, got: %v", err)
+		}
+	})
+}
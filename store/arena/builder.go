@@ -0,0 +1,356 @@
+package arena
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/postings"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var (
+	dimsErr        = errors.New("Vector length must be equal to the arena dims")
+	idsOverflowErr = errors.New("Number of vectors exceeds uint32 range")
+	builtErr       = errors.New("Arena is already built")
+)
+
+// ArenaBuilder is the write path of the arena store, which is used by Train:
+// vectors are written to the arena file right away, at the offset of their dense id,
+// and postings are kept in memory until Build sorts and writes them
+type ArenaBuilder struct {
+	mx       sync.RWMutex
+	dir      string
+	dims     int
+	vecFile  *os.File
+	ids      map[string]uint32
+	names    []string
+	present  []bool
+	postings map[store.BucketKey]*postings.List
+	built    bool
+	closed   bool
+}
+
+// NewArenaBuilder creates builder of the arena store in the directory for vectors of the given dims
+func NewArenaBuilder(dir string, dims int) (*ArenaBuilder, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	vecFile, err := os.OpenFile(filepath.Join(dir, vectorsFileName), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	b := &ArenaBuilder{
+		dir:      dir,
+		dims:     dims,
+		vecFile:  vecFile,
+		ids:      make(map[string]uint32),
+		postings: make(map[store.BucketKey]*postings.List),
+	}
+	err = b.writeHeader()
+	if err != nil {
+		vecFile.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *ArenaBuilder) writeHeader() error {
+	var header [headerSize]byte
+	binary.LittleEndian.PutUint64(header[:], uint64(b.dims))
+	_, err := b.vecFile.WriteAt(header[:], 0)
+	return err
+}
+
+// internalID returns dense id of the vector, assigning the new one if needed
+// NOTE: must be called under the write lock
+func (b *ArenaBuilder) internalID(id string) (uint32, error) {
+	if internal, ok := b.ids[id]; ok {
+		return internal, nil
+	}
+	if uint64(len(b.names)) > uint64(^uint32(0)) {
+		return 0, idsOverflowErr
+	}
+	internal := uint32(len(b.names))
+	b.ids[id] = internal
+	b.names = append(b.names, id)
+	b.present = append(b.present, false)
+	return internal, nil
+}
+
+func (b *ArenaBuilder) recordOffset(internal uint32) int64 {
+	return headerSize + int64(internal)*int64(b.dims)*8
+}
+
+func (b *ArenaBuilder) SetVector(ctx context.Context, id string, vec []float64) error {
+	return b.SetVectors(ctx, []string{id}, [][]float64{vec})
+}
+
+func (b *ArenaBuilder) SetVectors(ctx context.Context, ids []string, vecs [][]float64) error {
+	if len(ids) != len(vecs) {
+		return store.BatchLengthErr
+	}
+	record := make([]byte, 8*b.dims)
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.closed {
+		return store.ClosedErr
+	}
+	if b.built {
+		return builtErr
+	}
+	for i, id := range ids {
+		if len(vecs[i]) != b.dims {
+			return dimsErr
+		}
+		internal, err := b.internalID(id)
+		if err != nil {
+			return err
+		}
+		for j, v := range vecs[i] {
+			binary.LittleEndian.PutUint64(record[8*j:], math.Float64bits(v))
+		}
+		_, err = b.vecFile.WriteAt(record, b.recordOffset(internal))
+		if err != nil {
+			return err
+		}
+		b.present[internal] = true
+	}
+	return nil
+}
+
+// GetVector reads the vector back from the arena file
+func (b *ArenaBuilder) GetVector(ctx context.Context, id string) ([]float64, error) {
+	b.mx.RLock()
+	defer b.mx.RUnlock()
+	if b.closed {
+		return nil, store.ClosedErr
+	}
+	internal, ok := b.ids[id]
+	if !ok || !b.present[internal] {
+		return nil, store.KeyNotFoundErr
+	}
+	record := make([]byte, 8*b.dims)
+	_, err := b.vecFile.ReadAt(record, b.recordOffset(internal))
+	if err != nil {
+		return nil, err
+	}
+	vec := make([]float64, b.dims)
+	for j := range vec {
+		vec[j] = math.Float64frombits(binary.LittleEndian.Uint64(record[8*j:]))
+	}
+	return vec, nil
+}
+
+func (b *ArenaBuilder) SetHash(ctx context.Context, key store.BucketKey, vecId string) error {
+	return b.SetHashes(ctx, map[store.BucketKey][]string{key: {vecId}})
+}
+
+func (b *ArenaBuilder) SetHashes(ctx context.Context, hashes map[store.BucketKey][]string) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.closed {
+		return store.ClosedErr
+	}
+	if b.built {
+		return builtErr
+	}
+	for key, vecIds := range hashes {
+		bucket, ok := b.postings[key]
+		if !ok {
+			bucket = postings.NewList()
+			b.postings[key] = bucket
+		}
+		for _, vecId := range vecIds {
+			internal, err := b.internalID(vecId)
+			if err != nil {
+				return err
+			}
+			bucket.Add(internal)
+		}
+	}
+	return nil
+}
+
+// GetHashIterator returns iterator over the current bucket state
+func (b *ArenaBuilder) GetHashIterator(ctx context.Context, key store.BucketKey) (store.Iterator, error) {
+	b.mx.RLock()
+	defer b.mx.RUnlock()
+	bucket, ok := b.postings[key]
+	if !ok {
+		return nil, store.BucketNotFoundErr
+	}
+	return &postingIterator{
+		postings: bucket.Iterator(),
+		names:    b.names[:len(b.names):len(b.names)],
+	}, nil
+}
+
+// GetIdsIterator returns iterator over the snapshot of ids of the written vectors
+func (b *ArenaBuilder) GetIdsIterator(ctx context.Context) (store.Iterator, error) {
+	b.mx.RLock()
+	defer b.mx.RUnlock()
+	ids := make([]string, 0, len(b.names))
+	for i, id := range b.names {
+		if b.present[i] {
+			ids = append(ids, id)
+		}
+	}
+	return store.NewSliceIterator(ids), nil
+}
+
+// GetBucketsSizes returns number of entries in every bucket
+func (b *ArenaBuilder) GetBucketsSizes(ctx context.Context) (map[store.BucketKey]int, error) {
+	b.mx.RLock()
+	defer b.mx.RUnlock()
+	sizes := make(map[store.BucketKey]int, len(b.postings))
+	for key, bucket := range b.postings {
+		sizes[key] = bucket.Len()
+	}
+	return sizes, nil
+}
+
+// Clear truncates the arena file and drops postings
+func (b *ArenaBuilder) Clear(ctx context.Context) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.closed {
+		return store.ClosedErr
+	}
+	if b.built {
+		return builtErr
+	}
+	err := b.vecFile.Truncate(0)
+	if err != nil {
+		return err
+	}
+	b.ids = make(map[string]uint32)
+	b.names = nil
+	b.present = nil
+	b.postings = make(map[store.BucketKey]*postings.List)
+	return b.writeHeader()
+}
+
+func (b *ArenaBuilder) writeIDs() error {
+	f, err := os.Create(filepath.Join(b.dir, idsFileName))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	writer := bufio.NewWriter(f)
+	var buf [binary.MaxVarintLen64]byte
+	for i, id := range b.names {
+		flag := byte(0)
+		if b.present[i] {
+			flag = 1
+		}
+		writer.WriteByte(flag)
+		n := binary.PutUvarint(buf[:], uint64(len(id)))
+		writer.Write(buf[:n])
+		writer.WriteString(id)
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// writePostings writes directory sorted by the encoded keys and compressed blocks of every bucket;
+// NOTE: postings are re-sorted across the blocks of the list, so the whole bucket is ordered
+func (b *ArenaBuilder) writePostings() error {
+	keys := make([][]byte, 0, len(b.postings))
+	for key := range b.postings {
+		keys = append(keys, key.AppendBinary(nil))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	f, err := os.Create(filepath.Join(b.dir, postingsFileName))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	writer := bufio.NewWriter(f)
+	var buf [dirEntrySize]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(len(keys)))
+	writer.Write(buf[:headerSize])
+	blocks := make([]byte, 0)
+	for _, encoded := range keys {
+		var key store.BucketKey
+		key.UnmarshalBinary(encoded)
+		bucket := b.postings[key].Ids()
+		sort.Slice(bucket, func(i, j int) bool { return bucket[i] < bucket[j] })
+		copy(buf[:], encoded)
+		binary.LittleEndian.PutUint64(buf[store.BucketKeySize:], uint64(len(blocks)))
+		binary.LittleEndian.PutUint64(buf[store.BucketKeySize+8:], uint64(len(bucket)))
+		writer.Write(buf[:])
+		blocks = postings.AppendIds(blocks, bucket)
+	}
+	writer.Write(blocks)
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Build writes ids and postings, flushes the arena and opens it as the read-only store
+func (b *ArenaBuilder) Build() (*ArenaStore, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.closed {
+		return nil, store.ClosedErr
+	}
+	if b.built {
+		return nil, builtErr
+	}
+	// NOTE: vectors which were never set are left as zero-filled records
+	err := b.vecFile.Truncate(b.recordOffset(uint32(len(b.names))))
+	if err != nil {
+		return nil, err
+	}
+	err = b.vecFile.Sync()
+	if err != nil {
+		return nil, err
+	}
+	err = b.writeIDs()
+	if err != nil {
+		return nil, err
+	}
+	err = b.writePostings()
+	if err != nil {
+		return nil, err
+	}
+	b.built = true
+	b.vecFile.Close()
+	b.postings = nil
+	return NewArenaStore(b.dir)
+}
+
+// Close drops the arena which wasn't built: closes the arena file and removes
+// the files written to the directory, files of the built arena belong to the store
+func (b *ArenaBuilder) Close() error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	if b.built || b.closed {
+		return nil
+	}
+	b.closed = true
+	b.postings = nil
+	err := b.vecFile.Close()
+	for _, name := range []string{vectorsFileName, idsFileName, postingsFileName} {
+		removeErr := os.Remove(filepath.Join(b.dir, name))
+		if removeErr != nil && !os.IsNotExist(removeErr) && err == nil {
+			err = removeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,355 @@
+package arena
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/postings"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+var (
+	readOnlyErr    = errors.New("Arena store is read-only, use ArenaBuilder to write it")
+	arenaFormatErr = errors.New("Arena files are corrupted")
+	endiannessErr  = errors.New("Arena store requires little-endian host")
+)
+
+const (
+	vectorsFileName  = "vectors.arena"
+	idsFileName      = "ids.dat"
+	postingsFileName = "postings.blocks"
+
+	// NOTE: header holds dims of the vectors or number of the buckets
+	headerSize = 8
+	// dirEntrySize is a size of the bucket key, blocks offset and postings count
+	dirEntrySize = store.BucketKeySize + 16
+)
+
+func isLittleEndian() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}
+
+// float64View reinterprets mapped bytes as float64 values without copying
+func float64View(data []byte) []float64 {
+	var view []float64
+	if len(data) == 0 {
+		return view
+	}
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&view))
+	hdr.Data = uintptr(unsafe.Pointer(&data[0]))
+	hdr.Len = len(data) / 8
+	hdr.Cap = hdr.Len
+	return view
+}
+
+// ArenaStore serves vectors and buckets from the memory-mapped files:
+// vectors are fixed-width records in one arena, buckets are compressed blocks of sorted uint32 postings in another.
+// GetVector returns a view of the mapped memory, so it must not be modified;
+// neither vectors nor iterators must be used after Close
+type ArenaStore struct {
+	mx        sync.RWMutex
+	dims      int
+	files     []*os.File
+	mapped    [][]byte
+	vectors   []float64
+	directory []byte
+	postings  []byte
+	ids       map[string]uint32
+	names     []string
+	present   []bool
+	closed    bool
+}
+
+// NewArenaStore maps the files written by ArenaBuilder in the directory
+func NewArenaStore(dir string) (*ArenaStore, error) {
+	if !isLittleEndian() {
+		return nil, endiannessErr
+	}
+	s := &ArenaStore{
+		ids: make(map[string]uint32),
+	}
+	err := s.loadIDs(filepath.Join(dir, idsFileName))
+	if err != nil {
+		return nil, err
+	}
+	vecData, err := s.mapFile(filepath.Join(dir, vectorsFileName))
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	postData, err := s.mapFile(filepath.Join(dir, postingsFileName))
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	err = s.parse(vecData, postData)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ArenaStore) loadIDs(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	for {
+		flag, err := reader.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		idLen, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return arenaFormatErr
+		}
+		id := make([]byte, idLen)
+		_, err = io.ReadFull(reader, id)
+		if err != nil {
+			return arenaFormatErr
+		}
+		s.ids[string(id)] = uint32(len(s.names))
+		s.names = append(s.names, string(id))
+		s.present = append(s.present, flag == 1)
+	}
+}
+
+func (s *ArenaStore) mapFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s.files = append(s.files, f)
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := mapFile(f, int(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+	s.mapped = append(s.mapped, data)
+	return data, nil
+}
+
+func (s *ArenaStore) parse(vecData, postData []byte) error {
+	if len(vecData) < headerSize || len(postData) < headerSize {
+		return arenaFormatErr
+	}
+	s.dims = int(binary.LittleEndian.Uint64(vecData))
+	s.vectors = float64View(vecData[headerSize:])
+	if len(s.vectors) < s.dims*len(s.names) {
+		return arenaFormatErr
+	}
+	nBuckets := binary.LittleEndian.Uint64(postData)
+	dirEnd := headerSize + nBuckets*dirEntrySize
+	if dirEnd > uint64(len(postData)) {
+		return arenaFormatErr
+	}
+	s.directory = postData[headerSize:dirEnd]
+	s.postings = postData[dirEnd:]
+	// NOTE: lookups search the directory by key, so keys must be sorted and unique
+	prev := uint64(0)
+	var prevKey []byte
+	for i := 0; i < int(nBuckets); i++ {
+		entry := s.directory[i*dirEntrySize : (i+1)*dirEntrySize]
+		key := entry[:store.BucketKeySize]
+		if prevKey != nil && bytes.Compare(prevKey, key) >= 0 {
+			return arenaFormatErr
+		}
+		prevKey = key
+		start := binary.LittleEndian.Uint64(entry[store.BucketKeySize:])
+		if start < prev || start > uint64(len(s.postings)) {
+			return arenaFormatErr
+		}
+		prev = start
+	}
+	return nil
+}
+
+// entry returns bucket key, its blocks and number of postings from the directory;
+// blocks of the bucket end where the blocks of the next one start
+func (s *ArenaStore) entry(i int) (store.BucketKey, []byte, int) {
+	var key store.BucketKey
+	raw := s.directory[i*dirEntrySize : (i+1)*dirEntrySize]
+	key.UnmarshalBinary(raw[:store.BucketKeySize])
+	start := binary.LittleEndian.Uint64(raw[store.BucketKeySize:])
+	count := binary.LittleEndian.Uint64(raw[store.BucketKeySize+8:])
+	end := uint64(len(s.postings))
+	if next := (i + 1) * dirEntrySize; next < len(s.directory) {
+		end = binary.LittleEndian.Uint64(s.directory[next+store.BucketKeySize:])
+	}
+	return key, s.postings[start:end:end], int(count)
+}
+
+func (s *ArenaStore) SetVector(ctx context.Context, id string, vec []float64) error {
+	return readOnlyErr
+}
+
+func (s *ArenaStore) SetVectors(ctx context.Context, ids []string, vecs [][]float64) error {
+	return readOnlyErr
+}
+
+// GetVector returns zero-copy view of the vector record
+func (s *ArenaStore) GetVector(ctx context.Context, id string) ([]float64, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return nil, store.ClosedErr
+	}
+	internal, ok := s.ids[id]
+	if !ok || !s.present[internal] {
+		return nil, store.KeyNotFoundErr
+	}
+	start := int(internal) * s.dims
+	end := start + s.dims
+	return s.vectors[start:end:end], nil
+}
+
+func (s *ArenaStore) SetHash(ctx context.Context, key store.BucketKey, vecId string) error {
+	return readOnlyErr
+}
+
+func (s *ArenaStore) SetHashes(ctx context.Context, hashes map[store.BucketKey][]string) error {
+	return readOnlyErr
+}
+
+// postingIterator decodes postings blocks and converts internal ids to the string ones during iteration
+type postingIterator struct {
+	postings *postings.Iterator
+	names    []string
+	err      error
+}
+
+func (it *postingIterator) Next() (string, bool) {
+	if it.err != nil {
+		return "", false
+	}
+	internal, ok := it.postings.Next()
+	if !ok {
+		if it.postings.Err() != nil {
+			it.err = arenaFormatErr
+		}
+		return "", false
+	}
+	if int(internal) >= len(it.names) {
+		it.err = arenaFormatErr
+		return "", false
+	}
+	return it.names[internal], true
+}
+
+func (it *postingIterator) Err() error {
+	return it.err
+}
+
+func (it *postingIterator) Close() error {
+	it.postings = postings.NewIterator(nil)
+	it.names = nil
+	return nil
+}
+
+// GetHashIterator finds the bucket by binary search over the sorted directory
+func (s *ArenaStore) GetHashIterator(ctx context.Context, key store.BucketKey) (store.Iterator, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return nil, store.ClosedErr
+	}
+	encoded := key.AppendBinary(nil)
+	n := len(s.directory) / dirEntrySize
+	i := sort.Search(n, func(i int) bool {
+		raw := s.directory[i*dirEntrySize : i*dirEntrySize+store.BucketKeySize]
+		return bytes.Compare(raw, encoded) >= 0
+	})
+	if i == n {
+		return nil, store.BucketNotFoundErr
+	}
+	found, blocks, _ := s.entry(i)
+	if found != key {
+		return nil, store.BucketNotFoundErr
+	}
+	return &postingIterator{
+		postings: postings.NewIterator(blocks),
+		names:    s.names,
+	}, nil
+}
+
+// GetIdsIterator returns iterator over ids of the stored vectors
+func (s *ArenaStore) GetIdsIterator(ctx context.Context) (store.Iterator, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return nil, store.ClosedErr
+	}
+	ids := make([]string, 0, len(s.names))
+	for i, id := range s.names {
+		if s.present[i] {
+			ids = append(ids, id)
+		}
+	}
+	return store.NewSliceIterator(ids), nil
+}
+
+// GetBucketsSizes returns number of entries in every bucket
+func (s *ArenaStore) GetBucketsSizes(ctx context.Context) (map[store.BucketKey]int, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return nil, store.ClosedErr
+	}
+	n := len(s.directory) / dirEntrySize
+	sizes := make(map[store.BucketKey]int, n)
+	for i := 0; i < n; i++ {
+		key, _, count := s.entry(i)
+		sizes[key] = count
+	}
+	return sizes, nil
+}
+
+func (s *ArenaStore) Clear(ctx context.Context) error {
+	return readOnlyErr
+}
+
+// Close unmaps the files, vectors returned by the store become invalid
+func (s *ArenaStore) Close() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	var result error
+	for _, data := range s.mapped {
+		err := unmapFile(data)
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+	for _, f := range s.files {
+		err := f.Close()
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+	s.vectors = nil
+	s.directory = nil
+	s.postings = nil
+	return result
+}
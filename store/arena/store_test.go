@@ -0,0 +1,226 @@
+package arena
+
+import (
+	"context"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/storetest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestArenaStore(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "lsh-arena-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	builder, err := NewArenaBuilder(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []store.BucketKey{{Tree: 0, Hash: 42}, {Tree: 0, Hash: 7}, {Tree: 1, Hash: 0}}
+	var s *ArenaStore
+
+	t.Run("Builder", func(t *testing.T) {
+		err := builder.SetVectors(ctx, []string{"a", "b", "c"}, [][]float64{{1, 2}, {3, 4}, {5, 6}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = builder.SetVector(ctx, "d", []float64{1})
+		if err == nil {
+			t.Error("Vector of the wrong size must not be written")
+		}
+		err = builder.SetHashes(ctx, map[store.BucketKey][]string{
+			keys[0]: {"c", "a"},
+			keys[1]: {"b"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = builder.SetHash(ctx, keys[2], "e")
+		if err != nil {
+			t.Fatal(err)
+		}
+		vec, err := builder.GetVector(ctx, "b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vec, []float64{3, 4}) {
+			t.Errorf("Wrong vector: %v", vec)
+		}
+	})
+
+	t.Run("Build", func(t *testing.T) {
+		var err error
+		s, err = builder.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = builder.SetVector(ctx, "f", []float64{1, 1})
+		if err == nil {
+			t.Error("Built arena must not be written")
+		}
+	})
+	if s == nil {
+		t.FailNow()
+	}
+	defer s.Close()
+
+	t.Run("GetVector", func(t *testing.T) {
+		vec, err := s.GetVector(ctx, "c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vec, []float64{5, 6}) {
+			t.Errorf("Wrong vector: %v", vec)
+		}
+		// NOTE: id is known by the postings only, so its zero-filled record isn't returned
+		_, err = s.GetVector(ctx, "e")
+		if !errors.Is(err, store.KeyNotFoundErr) {
+			t.Errorf("Vector must not exist, got %v", err)
+		}
+		err = s.SetVector(ctx, "a", []float64{0, 0})
+		if err == nil {
+			t.Error("Arena store must be read-only")
+		}
+	})
+
+	t.Run("GetHashIterator", func(t *testing.T) {
+		ids, err := storetest.ReadBucket(ctx, s, keys[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, []string{"a", "c"}) {
+			t.Errorf("Wrong bucket: %v", ids)
+		}
+		_, err = s.GetHashIterator(ctx, store.BucketKey{Tree: 0, Hash: 8})
+		if err == nil {
+			t.Error("Missing bucket must return an error")
+		}
+		sizes, err := s.GetBucketsSizes(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[store.BucketKey]int{keys[0]: 2, keys[1]: 1, keys[2]: 1}
+		if !reflect.DeepEqual(sizes, expected) {
+			t.Errorf("Wrong buckets sizes: %v", sizes)
+		}
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		reopened, err := NewArenaStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reopened.Close()
+		ids, err := storetest.ReadBucket(ctx, reopened, keys[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, []string{"b"}) {
+			t.Errorf("Wrong bucket: %v", ids)
+		}
+	})
+
+	t.Run("UnsortedDirectory", func(t *testing.T) {
+		path := filepath.Join(dir, postingsFileName)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// NOTE: only keys of the first two entries are swapped, so offsets stay valid
+		first := data[headerSize : headerSize+store.BucketKeySize]
+		second := data[headerSize+dirEntrySize : headerSize+dirEntrySize+store.BucketKeySize]
+		tmp := append([]byte{}, first...)
+		copy(first, second)
+		copy(second, tmp)
+		err = ioutil.WriteFile(path, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = NewArenaStore(dir)
+		if err != arenaFormatErr {
+			t.Errorf("Unsorted directory must return %v, got %v", arenaFormatErr, err)
+		}
+	})
+}
+
+func TestArenaBuilderClose(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "lsh-arena-close")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	builder, err := NewArenaBuilder(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = builder.SetVector(ctx, "a", []float64{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = builder.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("Closed builder must remove its files, got %v", len(files))
+	}
+	err = builder.SetVector(ctx, "b", []float64{3, 4})
+	if !errors.Is(err, store.ClosedErr) {
+		t.Errorf("Closed builder must return %v, got %v", store.ClosedErr, err)
+	}
+	_, err = builder.Build()
+	if !errors.Is(err, store.ClosedErr) {
+		t.Errorf("Closed builder must not be built, got %v", err)
+	}
+}
+
+func TestArenaStoreSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lsh-arena-search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	builder, err := NewArenaBuilder(dir, storetest.SearchDims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := storetest.RunSearch(t, builder)
+	s, err := builder.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	f.CheckServed(t, s)
+}
+
+func TestConformance(t *testing.T) {
+	root, err := ioutil.TempDir("", "lsh-arena-conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	storetest.RunConformance(t, func() store.Store {
+		dir, err := ioutil.TempDir(root, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		builder, err := NewArenaBuilder(dir, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// NOTE: builder is closed after every case, which removes its files
+		return builder
+	})
+}
@@ -0,0 +1,75 @@
+package store
+
+import (
+	"context"
+)
+
+// batchAdapter implements batch writes by the single ones
+type batchAdapter struct {
+	SingleStore
+}
+
+// codeBatchAdapter keeps codes methods of the wrapped store
+type codeBatchAdapter struct {
+	batchAdapter
+	codes SingleCodeStore
+}
+
+// WithBatches turns store with single writes into the Store,
+// codes methods are kept when the wrapped store implements them
+func WithBatches(s SingleStore) Store {
+	adapter := batchAdapter{SingleStore: s}
+	if codes, ok := s.(SingleCodeStore); ok {
+		return &codeBatchAdapter{
+			batchAdapter: adapter,
+			codes:        codes,
+		}
+	}
+	return &adapter
+}
+
+func (a *batchAdapter) SetVectors(ctx context.Context, ids []string, vecs [][]float64) error {
+	if len(ids) != len(vecs) {
+		return BatchLengthErr
+	}
+	for i, id := range ids {
+		err := a.SetVector(ctx, id, vecs[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *batchAdapter) SetHashes(ctx context.Context, hashes map[BucketKey][]string) error {
+	for key, vecIds := range hashes {
+		for _, vecId := range vecIds {
+			err := a.SetHash(ctx, key, vecId)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (a *codeBatchAdapter) SetCode(ctx context.Context, id string, code []byte) error {
+	return a.codes.SetCode(ctx, id, code)
+}
+
+func (a *codeBatchAdapter) GetCode(ctx context.Context, id string) ([]byte, error) {
+	return a.codes.GetCode(ctx, id)
+}
+
+func (a *codeBatchAdapter) SetCodes(ctx context.Context, ids []string, codes [][]byte) error {
+	if len(ids) != len(codes) {
+		return BatchLengthErr
+	}
+	for i, id := range ids {
+		err := a.codes.SetCode(ctx, id, codes[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package cached
+
+import (
+	"container/list"
+)
+
+// entryOverhead is an approximate size of the list element and map entry,
+// so caches of the tiny values are bounded too
+const entryOverhead = 64
+
+type lruEntry struct {
+	key   interface{}
+	value interface{}
+	size  int64
+}
+
+// lru holds values up to the maxBytes total size and evicts the least recently used ones,
+// NOTE: it's not safe for the concurrent use, the store guards it with a mutex
+type lru struct {
+	maxBytes  int64
+	bytes     int64
+	order     *list.List
+	items     map[interface{}]*list.Element
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+func newLRU(maxBytes int64) *lru {
+	return &lru{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		items:    make(map[interface{}]*list.Element),
+	}
+}
+
+func (c *lru) get(key interface{}) (interface{}, bool) {
+	elem, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).value, true
+}
+
+// add puts value to the cache, values larger than the whole cache are skipped
+func (c *lru) add(key, value interface{}, size int64) {
+	size += entryOverhead
+	if size > c.maxBytes {
+		return
+	}
+	c.remove(key)
+	c.items[key] = c.order.PushFront(&lruEntry{key: key, value: value, size: size})
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.removeElement(c.order.Back())
+		c.evictions++
+	}
+}
+
+func (c *lru) remove(key interface{}) {
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *lru) removeElement(elem *list.Element) {
+	entry := c.order.Remove(elem).(*lruEntry)
+	delete(c.items, entry.key)
+	c.bytes -= entry.size
+}
+
+func (c *lru) purge() {
+	c.order.Init()
+	c.items = make(map[interface{}]*list.Element)
+	c.bytes = 0
+}
+
+func (c *lru) stats() CacheStats {
+	return CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   len(c.items),
+		Bytes:     c.bytes,
+	}
+}
+
+// CacheStats holds counters of a single cache
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int64
+}
+
+// HitRate returns share of the lookups served from the cache
+func (s CacheStats) HitRate() float64 {
+	lookups := s.Hits + s.Misses
+	if lookups == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(lookups)
+}
@@ -0,0 +1,241 @@
+package cached
+
+import (
+	"context"
+	"expvar"
+	"github.com/gasparian/lsh-search-go/store"
+	"io"
+	"sync"
+)
+
+const (
+	float64Size = 8
+	// stringSize is a size of the string header, which is added to every cached id
+	stringSize = 16
+)
+
+// Options holds sizes of the caches in bytes, zero size disables the cache
+type Options struct {
+	VectorsBytes int64
+	BucketsBytes int64
+}
+
+// Stats holds counters of the vectors and buckets caches
+type Stats struct {
+	Vectors CacheStats
+	Buckets CacheStats
+}
+
+// Store is the cached store, which reports hits and misses of its caches
+type Store interface {
+	store.Store
+	io.Closer
+	Stats() Stats
+	Publish(name string)
+}
+
+// cache guards lru with a mutex; gen is bumped on every invalidation,
+// so the value read from the store before the concurrent write isn't cached after it
+type cache struct {
+	mx  sync.Mutex
+	lru *lru
+	gen uint64
+}
+
+func newCache(maxBytes int64) *cache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &cache{lru: newLRU(maxBytes)}
+}
+
+func (c *cache) get(key interface{}) (interface{}, uint64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	value, ok := c.lru.get(key)
+	return value, c.gen, ok
+}
+
+// add caches value, unless the cache was invalidated after gen was read
+func (c *cache) add(gen uint64, key, value interface{}, size int64) {
+	if c == nil {
+		return
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.gen == gen {
+		c.lru.add(key, value, size)
+	}
+}
+
+func (c *cache) remove(keys ...interface{}) {
+	if c == nil {
+		return
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.gen++
+	for _, key := range keys {
+		c.lru.remove(key)
+	}
+}
+
+func (c *cache) purge() {
+	if c == nil {
+		return
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.gen++
+	c.lru.purge()
+}
+
+func (c *cache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.lru.stats()
+}
+
+// CachedStore keeps recently used vectors and bucket postings of the wrapped store in memory;
+// entries are invalidated by writes and Clear made through the CachedStore,
+// NOTE: writes made directly to the wrapped store are not visible until the entry is evicted
+type CachedStore struct {
+	store   store.Store
+	vectors *cache
+	buckets *cache
+}
+
+// cachedCodeStore keeps codes methods of the wrapped store, codes are not cached
+type cachedCodeStore struct {
+	*CachedStore
+	store.CodeStore
+}
+
+// NewCachedStore wraps the store, codes methods are kept
+// when the wrapped store implements them
+func NewCachedStore(s store.Store, opts Options) Store {
+	cached := &CachedStore{
+		store:   s,
+		vectors: newCache(opts.VectorsBytes),
+		buckets: newCache(opts.BucketsBytes),
+	}
+	if codes, ok := s.(store.CodeStore); ok {
+		return &cachedCodeStore{
+			CachedStore: cached,
+			CodeStore:   codes,
+		}
+	}
+	return cached
+}
+
+// Stats returns current counters of the caches
+func (s *CachedStore) Stats() Stats {
+	return Stats{
+		Vectors: s.vectors.stats(),
+		Buckets: s.buckets.stats(),
+	}
+}
+
+// Publish exposes stats as the expvar variable,
+// NOTE: expvar panics when the name is already published
+func (s *CachedStore) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return s.Stats()
+	}))
+}
+
+func (s *CachedStore) SetVector(ctx context.Context, id string, vec []float64) error {
+	defer s.vectors.remove(id)
+	return s.store.SetVector(ctx, id, vec)
+}
+
+func (s *CachedStore) SetVectors(ctx context.Context, ids []string, vecs [][]float64) error {
+	keys := make([]interface{}, len(ids))
+	for i, id := range ids {
+		keys[i] = id
+	}
+	defer s.vectors.remove(keys...)
+	return s.store.SetVectors(ctx, ids, vecs)
+}
+
+func (s *CachedStore) GetVector(ctx context.Context, id string) ([]float64, error) {
+	value, gen, ok := s.vectors.get(id)
+	if ok {
+		return value.([]float64), nil
+	}
+	vec, err := s.store.GetVector(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	s.vectors.add(gen, id, vec, int64(len(vec)*float64Size+len(id)+stringSize))
+	return vec, nil
+}
+
+func (s *CachedStore) SetHash(ctx context.Context, key store.BucketKey, vecId string) error {
+	defer s.buckets.remove(key)
+	return s.store.SetHash(ctx, key, vecId)
+}
+
+func (s *CachedStore) SetHashes(ctx context.Context, hashes map[store.BucketKey][]string) error {
+	keys := make([]interface{}, 0, len(hashes))
+	for key := range hashes {
+		keys = append(keys, key)
+	}
+	defer s.buckets.remove(keys...)
+	return s.store.SetHashes(ctx, hashes)
+}
+
+// GetHashIterator reads the whole bucket on the cache miss,
+// NOTE: so the search which stops early on MaxCandidates reads more ids from the store
+func (s *CachedStore) GetHashIterator(ctx context.Context, key store.BucketKey) (store.Iterator, error) {
+	value, gen, ok := s.buckets.get(key)
+	if ok {
+		return store.NewSliceIterator(value.([]string)), nil
+	}
+	it, err := s.store.GetHashIterator(ctx, key)
+	if err != nil || s.buckets == nil {
+		return it, err
+	}
+	defer it.Close()
+	ids := make([]string, 0)
+	size := 0
+	for id, ok := it.Next(); ok; id, ok = it.Next() {
+		ids = append(ids, id)
+		size += len(id) + stringSize
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	s.buckets.add(gen, key, ids, int64(size))
+	return store.NewSliceIterator(ids), nil
+}
+
+func (s *CachedStore) GetBucketsSizes(ctx context.Context) (map[store.BucketKey]int, error) {
+	return s.store.GetBucketsSizes(ctx)
+}
+
+func (s *CachedStore) GetIdsIterator(ctx context.Context) (store.Iterator, error) {
+	return s.store.GetIdsIterator(ctx)
+}
+
+func (s *CachedStore) Clear(ctx context.Context) error {
+	defer func() {
+		s.vectors.purge()
+		s.buckets.purge()
+	}()
+	return s.store.Clear(ctx)
+}
+
+// Close closes the wrapped store, when it needs closing
+func (s *CachedStore) Close() error {
+	if closer, ok := s.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package cached
+
+import (
+	"context"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/instrumented"
+	"github.com/gasparian/lsh-search-go/store/kv"
+	"github.com/gasparian/lsh-search-go/store/storetest"
+	"reflect"
+	"testing"
+)
+
+func TestLRU(t *testing.T) {
+	c := newLRU(3 * (entryOverhead + 1))
+	c.add("a", 1, 1)
+	c.add("b", 2, 1)
+	c.add("c", 3, 1)
+	c.get("a")
+	c.add("d", 4, 1)
+	if _, ok := c.get("b"); ok {
+		t.Error("Least recently used entry must be evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("Entry %v must stay in the cache", key)
+		}
+	}
+	c.add("e", 5, 3*entryOverhead)
+	if _, ok := c.get("e"); ok {
+		t.Error("Entry larger than the cache must not be added")
+	}
+	stats := c.stats()
+	if stats.Evictions != 1 || stats.Entries != 3 || stats.Bytes != 3*(entryOverhead+1) {
+		t.Errorf("Wrong stats: %+v", stats)
+	}
+	if stats.HitRate() != 4.0/6.0 {
+		t.Errorf("Wrong hit rate: %v", stats.HitRate())
+	}
+	c.purge()
+	if c.stats().Entries != 0 || c.stats().Bytes != 0 {
+		t.Errorf("Cache must be empty after purge: %+v", c.stats())
+	}
+}
+
+func TestCachedStore(t *testing.T) {
+	ctx := context.Background()
+	backend := instrumented.NewInstrumentedStore(kv.NewKVStore())
+	s := NewCachedStore(backend, Options{VectorsBytes: 1 << 20, BucketsBytes: 1 << 20})
+	key := store.BucketKey{Tree: 0, Hash: 42}
+	err := s.SetVectors(ctx, []string{"a", "b"}, [][]float64{{1, 2}, {3, 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetHashes(ctx, map[store.BucketKey][]string{key: {"a", "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Hits", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			vec, err := s.GetVector(ctx, "a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(vec, []float64{1, 2}) {
+				t.Errorf("Wrong vector: %v", vec)
+			}
+			ids, err := storetest.ReadBucket(ctx, s, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ids, []string{"a", "b"}) {
+				t.Errorf("Wrong bucket: %v", ids)
+			}
+		}
+		snapshot := backend.Snapshot()
+		if snapshot[instrumented.GetVector].Calls != 1 || snapshot[instrumented.GetHashIterator].Calls != 1 {
+			t.Error("Cached entries must not be read from the wrapped store")
+		}
+		stats := s.Stats()
+		if stats.Vectors.Hits != 2 || stats.Vectors.Misses != 1 || stats.Buckets.Hits != 2 {
+			t.Errorf("Wrong stats: %+v", stats)
+		}
+		_, err := s.GetVector(ctx, "c")
+		if !errors.Is(err, store.KeyNotFoundErr) {
+			t.Errorf("Missing vector must return %v, got %v", store.KeyNotFoundErr, err)
+		}
+	})
+
+	t.Run("Invalidation", func(t *testing.T) {
+		err := s.SetVector(ctx, "a", []float64{5, 6})
+		if err != nil {
+			t.Fatal(err)
+		}
+		vec, err := s.GetVector(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vec, []float64{5, 6}) {
+			t.Errorf("Updated vector must be returned, got %v", vec)
+		}
+		err = s.SetHash(ctx, key, "c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := storetest.ReadBucket(ctx, s, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, []string{"a", "b", "c"}) {
+			t.Errorf("Updated bucket must be returned, got %v", ids)
+		}
+		err = s.Clear(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.GetVector(ctx, "a")
+		if !errors.Is(err, store.KeyNotFoundErr) {
+			t.Errorf("Vector must be removed by Clear, got %v", err)
+		}
+		_, err = s.GetHashIterator(ctx, key)
+		if !errors.Is(err, store.BucketNotFoundErr) {
+			t.Errorf("Bucket must be removed by Clear, got %v", err)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		s := NewCachedStore(kv.NewKVStore(), Options{})
+		err := s.SetVector(ctx, "a", []float64{1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.GetVector(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Stats() != (Stats{}) {
+			t.Errorf("Disabled caches must not count lookups: %+v", s.Stats())
+		}
+	})
+
+	t.Run("CodeStore", func(t *testing.T) {
+		if _, ok := s.(store.CodeStore); !ok {
+			t.Error("Wrapped code store must stay the code store")
+		}
+	})
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func() store.Store {
+		return NewCachedStore(kv.NewKVStore(), Options{VectorsBytes: 1 << 20, BucketsBytes: 1 << 10})
+	})
+}
@@ -0,0 +1,279 @@
+package compact
+
+import (
+	"context"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/postings"
+	"sync"
+)
+
+var (
+	idsOverflowErr = errors.New("Number of vectors exceeds uint32 range")
+)
+
+const (
+	// NOTE: rough sizes of the go runtime structures, used for the memory estimation
+	sliceHeaderSize  = 24
+	stringHeaderSize = 16
+	mapEntryOverhead = 16
+	bucketKeySize    = 16
+)
+
+// MemoryUsage holds estimated number of bytes used by the store parts
+type MemoryUsage struct {
+	Vectors  int
+	Codes    int
+	Postings int
+	IDs      int
+}
+
+// Total returns overall number of bytes
+func (m MemoryUsage) Total() int {
+	return m.Vectors + m.Codes + m.Postings + m.IDs
+}
+
+// CompactStore is in-memory store which assigns dense uint32 ids to the vectors
+// and keeps buckets as compressed append-only posting lists of these ids,
+// so every (tree, vector) pair costs about a byte or two instead of 4
+type CompactStore struct {
+	mx      sync.RWMutex
+	ids     map[string]uint32
+	names   []string
+	vecs    [][]float64
+	codes   [][]byte
+	buckets map[store.BucketKey]*postings.List
+}
+
+func NewCompactStore() *CompactStore {
+	return &CompactStore{
+		ids:     make(map[string]uint32),
+		buckets: make(map[store.BucketKey]*postings.List),
+	}
+}
+
+// postingIterator decodes posting list lazily and converts internal ids to the string ones
+type postingIterator struct {
+	postings *postings.Iterator
+	names    []string
+}
+
+func (it *postingIterator) Next() (string, bool) {
+	internal, ok := it.postings.Next()
+	if !ok {
+		return "", false
+	}
+	return it.names[internal], true
+}
+
+func (it *postingIterator) Err() error {
+	return it.postings.Err()
+}
+
+func (it *postingIterator) Close() error {
+	it.postings = postings.NewIterator(nil)
+	it.names = nil
+	return nil
+}
+
+// bucket returns posting list of the key, creating it if needed
+// NOTE: must be called under the write lock
+func (s *CompactStore) bucket(key store.BucketKey) *postings.List {
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = postings.NewList()
+		s.buckets[key] = bucket
+	}
+	return bucket
+}
+
+// internalID returns dense id of the vector, assigning the new one if needed
+// NOTE: must be called under the write lock
+func (s *CompactStore) internalID(id string) (uint32, error) {
+	if internal, ok := s.ids[id]; ok {
+		return internal, nil
+	}
+	if uint64(len(s.names)) > uint64(^uint32(0)) {
+		return 0, idsOverflowErr
+	}
+	internal := uint32(len(s.names))
+	s.ids[id] = internal
+	s.names = append(s.names, id)
+	s.vecs = append(s.vecs, nil)
+	s.codes = append(s.codes, nil)
+	return internal, nil
+}
+
+func (s *CompactStore) SetVector(ctx context.Context, id string, vec []float64) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	internal, err := s.internalID(id)
+	if err != nil {
+		return err
+	}
+	s.vecs[internal] = vec
+	return nil
+}
+
+func (s *CompactStore) SetVectors(ctx context.Context, ids []string, vecs [][]float64) error {
+	if len(ids) != len(vecs) {
+		return store.BatchLengthErr
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for i, id := range ids {
+		internal, err := s.internalID(id)
+		if err != nil {
+			return err
+		}
+		s.vecs[internal] = vecs[i]
+	}
+	return nil
+}
+
+func (s *CompactStore) GetVector(ctx context.Context, id string) ([]float64, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	internal, ok := s.ids[id]
+	if !ok || s.vecs[internal] == nil {
+		return nil, store.KeyNotFoundErr
+	}
+	return s.vecs[internal], nil
+}
+
+func (s *CompactStore) SetCode(ctx context.Context, id string, code []byte) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	internal, err := s.internalID(id)
+	if err != nil {
+		return err
+	}
+	s.codes[internal] = code
+	return nil
+}
+
+func (s *CompactStore) SetCodes(ctx context.Context, ids []string, codes [][]byte) error {
+	if len(ids) != len(codes) {
+		return store.BatchLengthErr
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for i, id := range ids {
+		internal, err := s.internalID(id)
+		if err != nil {
+			return err
+		}
+		s.codes[internal] = codes[i]
+	}
+	return nil
+}
+
+func (s *CompactStore) GetCode(ctx context.Context, id string) ([]byte, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	internal, ok := s.ids[id]
+	if !ok || s.codes[internal] == nil {
+		return nil, store.KeyNotFoundErr
+	}
+	return s.codes[internal], nil
+}
+
+func (s *CompactStore) SetHash(ctx context.Context, key store.BucketKey, vecId string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	internal, err := s.internalID(vecId)
+	if err != nil {
+		return err
+	}
+	s.bucket(key).Add(internal)
+	return nil
+}
+
+func (s *CompactStore) SetHashes(ctx context.Context, hashes map[store.BucketKey][]string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for key, vecIds := range hashes {
+		bucket := s.bucket(key)
+		for _, vecId := range vecIds {
+			internal, err := s.internalID(vecId)
+			if err != nil {
+				return err
+			}
+			bucket.Add(internal)
+		}
+	}
+	return nil
+}
+
+// GetHashIterator returns iterator over the current bucket state;
+// posting lists and ids table are append-only, so the iterator holds them without copying,
+// ids are returned sorted within the blocks of postings.BlockSize
+func (s *CompactStore) GetHashIterator(ctx context.Context, key store.BucketKey) (store.Iterator, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	bucket, ok := s.buckets[key]
+	if !ok {
+		return nil, store.BucketNotFoundErr
+	}
+	return &postingIterator{
+		postings: bucket.Iterator(),
+		names:    s.names[:len(s.names):len(s.names)],
+	}, nil
+}
+
+// GetIdsIterator returns iterator over the snapshot of ids of the stored vectors and codes,
+// ids which are only referenced by buckets are skipped
+func (s *CompactStore) GetIdsIterator(ctx context.Context) (store.Iterator, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	ids := make([]string, 0, len(s.names))
+	for i, id := range s.names {
+		if s.vecs[i] != nil || s.codes[i] != nil {
+			ids = append(ids, id)
+		}
+	}
+	return store.NewSliceIterator(ids), nil
+}
+
+// GetBucketsSizes returns number of entries in every bucket
+func (s *CompactStore) GetBucketsSizes(ctx context.Context) (map[store.BucketKey]int, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	sizes := make(map[store.BucketKey]int, len(s.buckets))
+	for key, bucket := range s.buckets {
+		sizes[key] = bucket.Len()
+	}
+	return sizes, nil
+}
+
+// MemoryUsage estimates memory used by the stored data
+func (s *CompactStore) MemoryUsage() MemoryUsage {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	usage := MemoryUsage{}
+	for _, vec := range s.vecs {
+		usage.Vectors += sliceHeaderSize + 8*cap(vec)
+	}
+	for _, code := range s.codes {
+		usage.Codes += sliceHeaderSize + cap(code)
+	}
+	for _, bucket := range s.buckets {
+		usage.Postings += bucketKeySize + mapEntryOverhead + bucket.SizeBytes()
+	}
+	for _, name := range s.names {
+		// NOTE: string is shared by the map key and the names table
+		usage.IDs += 2*stringHeaderSize + len(name) + 4 + mapEntryOverhead
+	}
+	return usage
+}
+
+func (s *CompactStore) Clear(ctx context.Context) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.ids = make(map[string]uint32)
+	s.names = nil
+	s.vecs = nil
+	s.codes = nil
+	s.buckets = make(map[store.BucketKey]*postings.List)
+	return nil
+}
@@ -0,0 +1,49 @@
+package compact
+
+import (
+	"context"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/storetest"
+	"testing"
+)
+
+func TestCompactStoreMemory(t *testing.T) {
+	ctx := context.Background()
+	s := NewCompactStore()
+	const N = 1000
+	hashes := make(map[store.BucketKey][]string)
+	for tree := 0; tree < 10; tree++ {
+		key := store.BucketKey{Tree: tree}
+		for i := 0; i < N; i++ {
+			hashes[key] = append(hashes[key], fmt.Sprint(i))
+		}
+	}
+	err := s.SetHashes(ctx, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage := s.MemoryUsage()
+	// NOTE: ids are dense, so the postings are stored as bitmaps
+	if usage.Postings > 10*N {
+		t.Errorf("Posting lists must take less than a byte per entry, got %v bytes for %v entries", usage.Postings, 10*N)
+	}
+	if usage.IDs == 0 || usage.Total() < usage.Postings+usage.IDs {
+		t.Errorf("Wrong memory usage estimation: %+v", usage)
+	}
+	it, err := s.GetHashIterator(ctx, store.BucketKey{Tree: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	for i := 0; i < N; i++ {
+		id, ok := it.Next()
+		if !ok || id != fmt.Sprint(i) {
+			t.Fatalf("Posting list must keep the insertion order, got %v at %v", id, i)
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func() store.Store { return NewCompactStore() })
+}
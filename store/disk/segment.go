@@ -0,0 +1,162 @@
+package disk
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+var (
+	corruptedRecordErr = errors.New("Record is corrupted")
+)
+
+// NOTE: every record is prefixed by the body length and its crc32 checksum
+const recordHeaderSize = 8
+
+// recordRef points to the record inside the segment file
+type recordRef struct {
+	offset int64
+	size   uint32
+}
+
+// segment is an append-only file of checksummed records
+type segment struct {
+	file *os.File
+	size int64
+}
+
+// openSegment opens the file, scans existing records and
+// truncates the incomplete tail, which is left by the interrupted write;
+// broken record before the tail is returned as the corruption error
+func openSegment(path string, fn func(ref recordRef, body []byte) error) (*segment, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	sg := &segment{file: file}
+	err = sg.scan(fn)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return sg, nil
+}
+
+func (sg *segment) scan(fn func(ref recordRef, body []byte) error) error {
+	info, err := sg.file.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := info.Size()
+	_, err = sg.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(sg.file)
+	var header [recordHeaderSize]byte
+	var offset int64
+	for {
+		_, err = io.ReadFull(reader, header[:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		size := binary.LittleEndian.Uint32(header[:4])
+		end := offset + recordHeaderSize + int64(size)
+		// NOTE: garbage length in the torn tail must not allocate the body, which can't be in the file
+		if end > fileSize {
+			break
+		}
+		body := make([]byte, size)
+		_, err = io.ReadFull(reader, body)
+		if err != nil {
+			return err
+		}
+		if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(header[4:]) {
+			// NOTE: only the last record could be torn, broken record in the middle means
+			// the file is corrupted, and truncating it would drop the valid records after it
+			if end == fileSize {
+				break
+			}
+			return corruptedRecordErr
+		}
+		err = fn(recordRef{offset: offset, size: size}, body)
+		if err != nil {
+			return err
+		}
+		offset = end
+	}
+	sg.size = offset
+	return sg.file.Truncate(offset)
+}
+
+// append writes records with a single call and returns their refs
+func (sg *segment) append(bodies ...[]byte) ([]recordRef, error) {
+	total := 0
+	for _, body := range bodies {
+		total += recordHeaderSize + len(body)
+	}
+	buf := make([]byte, 0, total)
+	refs := make([]recordRef, len(bodies))
+	offset := sg.size
+	for i, body := range bodies {
+		var header [recordHeaderSize]byte
+		binary.LittleEndian.PutUint32(header[:4], uint32(len(body)))
+		binary.LittleEndian.PutUint32(header[4:], crc32.ChecksumIEEE(body))
+		buf = append(buf, header[:]...)
+		buf = append(buf, body...)
+		refs[i] = recordRef{offset: offset, size: uint32(len(body))}
+		offset += recordHeaderSize + int64(len(body))
+	}
+	_, err := sg.file.WriteAt(buf, sg.size)
+	if err != nil {
+		// NOTE: drop partially written records, so the next append doesn't leave a gap
+		sg.file.Truncate(sg.size)
+		return nil, err
+	}
+	sg.size = offset
+	return refs, nil
+}
+
+// read returns the record body, checking its checksum
+func (sg *segment) read(ref recordRef) ([]byte, error) {
+	buf := make([]byte, recordHeaderSize+int(ref.size))
+	_, err := sg.file.ReadAt(buf, ref.offset)
+	if err != nil {
+		return nil, err
+	}
+	body := buf[recordHeaderSize:]
+	if binary.LittleEndian.Uint32(buf[:4]) != ref.size ||
+		binary.LittleEndian.Uint32(buf[4:8]) != crc32.ChecksumIEEE(body) {
+		return nil, corruptedRecordErr
+	}
+	return body, nil
+}
+
+func (sg *segment) truncate() error {
+	err := sg.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	sg.size = 0
+	return nil
+}
+
+func (sg *segment) sync() error {
+	return sg.file.Sync()
+}
+
+func (sg *segment) close() error {
+	return sg.file.Close()
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
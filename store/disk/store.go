@@ -0,0 +1,628 @@
+package disk
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/postings"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	storeClearedErr = errors.New("Store was cleared during the iteration")
+	idsOverflowErr  = errors.New("Number of ids exceeds uint32 range")
+)
+
+const (
+	vectorsFileName  = "vectors.seg"
+	postingsFileName = "postings.blocks.log"
+
+	vectorRecord byte = 0
+	codeRecord   byte = 1
+
+	// NOTE: postings log holds new entries of the dense ids table and compressed bucket chunks
+	idsRecord    byte = 0
+	blocksRecord byte = 1
+
+	DefaultSyncInterval = time.Second
+)
+
+// SyncPolicy defines when written data is flushed to the disk
+type SyncPolicy int
+
+const (
+	// SyncNone leaves flushing to the OS, data survives process crash but not the power loss
+	SyncNone SyncPolicy = iota
+	// SyncEveryWrite flushes files after every write call, batch writes are flushed once
+	SyncEveryWrite
+	// SyncInterval flushes files in background every Options.SyncInterval
+	SyncInterval
+)
+
+// Options holds disk store settings
+type Options struct {
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+}
+
+// bucketIndex holds offsets of the bucket chunks in the postings log
+type bucketIndex struct {
+	chunks []recordRef
+	size   int
+}
+
+// DiskStore keeps vectors and codes in the flat segment file and
+// bucket postings in the append-only log, as compressed blocks of the dense uint32 ids;
+// only offsets and the dense ids table are kept in memory,
+// and they are restored by scanning the files, when the existing directory is opened
+type DiskStore struct {
+	mx       sync.RWMutex
+	opts     Options
+	vectors  *segment
+	postings *segment
+	vecs     map[string]recordRef
+	codes    map[string]recordRef
+	buckets  map[store.BucketKey]*bucketIndex
+	ids      map[string]uint32
+	names    []string
+	// NOTE: generation is incremented by Clear, so the opened iterators don't read the new data
+	gen    uint64
+	closed bool
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewDiskStore opens store in the directory, creating it if needed
+func NewDiskStore(dir string, opts Options) (*DiskStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	s := &DiskStore{
+		opts:    opts,
+		vecs:    make(map[string]recordRef),
+		codes:   make(map[string]recordRef),
+		buckets: make(map[store.BucketKey]*bucketIndex),
+		ids:     make(map[string]uint32),
+		stop:    make(chan struct{}),
+	}
+	s.vectors, err = openSegment(filepath.Join(dir, vectorsFileName), s.indexVector)
+	if err != nil {
+		return nil, err
+	}
+	s.postings, err = openSegment(filepath.Join(dir, postingsFileName), s.indexPostings)
+	if err != nil {
+		s.vectors.close()
+		return nil, err
+	}
+	if opts.Sync == SyncInterval {
+		interval := opts.SyncInterval
+		if interval <= 0 {
+			interval = DefaultSyncInterval
+		}
+		s.wg.Add(1)
+		go s.syncLoop(interval)
+	}
+	return s, nil
+}
+
+func (s *DiskStore) syncLoop(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Sync()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// indexVector restores vector offset from the scanned record
+func (s *DiskStore) indexVector(ref recordRef, body []byte) error {
+	kind, id, _, err := decodeVectorRecord(body)
+	if err != nil {
+		return err
+	}
+	if kind == codeRecord {
+		s.codes[id] = ref
+	} else {
+		s.vecs[id] = ref
+	}
+	return nil
+}
+
+// indexPostings restores the ids table or bucket chunk offset from the scanned record
+func (s *DiskStore) indexPostings(ref recordRef, body []byte) error {
+	if len(body) > 0 && body[0] == idsRecord {
+		first, ids, err := decodeIdsRecord(body)
+		if err != nil {
+			return err
+		}
+		if first != len(s.names) {
+			return corruptedRecordErr
+		}
+		for _, id := range ids {
+			s.ids[id] = uint32(len(s.names))
+			s.names = append(s.names, id)
+		}
+		return nil
+	}
+	key, count, _, err := decodePostingsRecord(body)
+	if err != nil {
+		return err
+	}
+	s.addChunk(key, ref, count)
+	return nil
+}
+
+func (s *DiskStore) addChunk(key store.BucketKey, ref recordRef, size int) {
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &bucketIndex{}
+		s.buckets[key] = bucket
+	}
+	bucket.chunks = append(bucket.chunks, ref)
+	bucket.size += size
+}
+
+// encodeVectorRecord builds record body: kind, id length, id and the payload
+func encodeVectorRecord(kind byte, id string, payload []byte) []byte {
+	body := make([]byte, 0, 1+binary.MaxVarintLen64+len(id)+len(payload))
+	body = append(body, kind)
+	body = appendUvarint(body, uint64(len(id)))
+	body = append(body, id...)
+	return append(body, payload...)
+}
+
+func decodeVectorRecord(body []byte) (byte, string, []byte, error) {
+	if len(body) == 0 {
+		return 0, "", nil, corruptedRecordErr
+	}
+	idLen, n := binary.Uvarint(body[1:])
+	if n <= 0 || uint64(len(body)-1-n) < idLen {
+		return 0, "", nil, corruptedRecordErr
+	}
+	start := 1 + n
+	end := start + int(idLen)
+	return body[0], string(body[start:end]), body[end:], nil
+}
+
+func encodeFloats(vec []float64) []byte {
+	buf := make([]byte, 8*len(vec))
+	for i, v := range vec {
+		binary.LittleEndian.PutUint64(buf[8*i:], math.Float64bits(v))
+	}
+	return buf
+}
+
+func decodeFloats(buf []byte) []float64 {
+	vec := make([]float64, len(buf)/8)
+	for i := range vec {
+		vec[i] = math.Float64frombits(binary.LittleEndian.Uint64(buf[8*i:]))
+	}
+	return vec
+}
+
+// encodeIdsRecord builds record body: kind, first dense id, number of ids and length-prefixed ids
+func encodeIdsRecord(first int, ids []string) []byte {
+	size := 1 + 2*binary.MaxVarintLen64
+	for _, id := range ids {
+		size += binary.MaxVarintLen64 + len(id)
+	}
+	body := append(make([]byte, 0, size), idsRecord)
+	body = appendUvarint(body, uint64(first))
+	body = appendUvarint(body, uint64(len(ids)))
+	for _, id := range ids {
+		body = appendUvarint(body, uint64(len(id)))
+		body = append(body, id...)
+	}
+	return body
+}
+
+func decodeIdsRecord(body []byte) (int, []string, error) {
+	body = body[1:]
+	first, n := binary.Uvarint(body)
+	if n <= 0 {
+		return 0, nil, corruptedRecordErr
+	}
+	body = body[n:]
+	count, n := binary.Uvarint(body)
+	if n <= 0 || count > uint64(len(body)) {
+		return 0, nil, corruptedRecordErr
+	}
+	body = body[n:]
+	ids := make([]string, count)
+	for i := range ids {
+		idLen, n := binary.Uvarint(body)
+		if n <= 0 || uint64(len(body)-n) < idLen {
+			return 0, nil, corruptedRecordErr
+		}
+		ids[i] = string(body[n : n+int(idLen)])
+		body = body[n+int(idLen):]
+	}
+	return int(first), ids, nil
+}
+
+// encodePostingsRecord builds record body: kind, bucket key, number of ids and postings blocks of the sorted ids
+func encodePostingsRecord(key store.BucketKey, internals []uint32) []byte {
+	sort.Slice(internals, func(i, j int) bool { return internals[i] < internals[j] })
+	body := append(make([]byte, 0, 1+store.BucketKeySize+binary.MaxVarintLen64+2*len(internals)), blocksRecord)
+	body = key.AppendBinary(body)
+	body = appendUvarint(body, uint64(len(internals)))
+	return postings.AppendIds(body, internals)
+}
+
+func decodePostingsRecord(body []byte) (store.BucketKey, int, []byte, error) {
+	var key store.BucketKey
+	if len(body) < 1+store.BucketKeySize || body[0] != blocksRecord {
+		return key, 0, nil, corruptedRecordErr
+	}
+	key.UnmarshalBinary(body[1 : 1+store.BucketKeySize])
+	body = body[1+store.BucketKeySize:]
+	// NOTE: count isn't bounded by the body size, since dense blocks are stored as bitmaps
+	count, n := binary.Uvarint(body)
+	if n <= 0 || count > uint64(^uint32(0)) {
+		return key, 0, nil, corruptedRecordErr
+	}
+	return key, int(count), body[n:], nil
+}
+
+// afterWrite flushes the segment, if the policy requires it
+func (s *DiskStore) afterWrite(sg *segment) error {
+	if s.opts.Sync != SyncEveryWrite {
+		return nil
+	}
+	return sg.sync()
+}
+
+func (s *DiskStore) setRecords(kind byte, ids []string, payloads [][]byte) error {
+	bodies := make([][]byte, len(ids))
+	for i, id := range ids {
+		bodies[i] = encodeVectorRecord(kind, id, payloads[i])
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.closed {
+		return store.ClosedErr
+	}
+	refs, err := s.vectors.append(bodies...)
+	if err != nil {
+		return err
+	}
+	index := s.vecs
+	if kind == codeRecord {
+		index = s.codes
+	}
+	for i, id := range ids {
+		index[id] = refs[i]
+	}
+	return s.afterWrite(s.vectors)
+}
+
+func (s *DiskStore) getRecord(kind byte, id string) ([]byte, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return nil, store.ClosedErr
+	}
+	index := s.vecs
+	if kind == codeRecord {
+		index = s.codes
+	}
+	ref, ok := index[id]
+	if !ok {
+		return nil, store.KeyNotFoundErr
+	}
+	body, err := s.vectors.read(ref)
+	if err != nil {
+		return nil, err
+	}
+	_, _, payload, err := decodeVectorRecord(body)
+	return payload, err
+}
+
+func (s *DiskStore) SetVector(ctx context.Context, id string, vec []float64) error {
+	return s.setRecords(vectorRecord, []string{id}, [][]byte{encodeFloats(vec)})
+}
+
+func (s *DiskStore) SetVectors(ctx context.Context, ids []string, vecs [][]float64) error {
+	if len(ids) != len(vecs) {
+		return store.BatchLengthErr
+	}
+	payloads := make([][]byte, len(vecs))
+	for i, vec := range vecs {
+		payloads[i] = encodeFloats(vec)
+	}
+	return s.setRecords(vectorRecord, ids, payloads)
+}
+
+func (s *DiskStore) GetVector(ctx context.Context, id string) ([]float64, error) {
+	payload, err := s.getRecord(vectorRecord, id)
+	if err != nil {
+		return nil, err
+	}
+	return decodeFloats(payload), nil
+}
+
+func (s *DiskStore) SetCode(ctx context.Context, id string, code []byte) error {
+	return s.setRecords(codeRecord, []string{id}, [][]byte{code})
+}
+
+func (s *DiskStore) SetCodes(ctx context.Context, ids []string, codes [][]byte) error {
+	if len(ids) != len(codes) {
+		return store.BatchLengthErr
+	}
+	return s.setRecords(codeRecord, ids, codes)
+}
+
+func (s *DiskStore) GetCode(ctx context.Context, id string) ([]byte, error) {
+	return s.getRecord(codeRecord, id)
+}
+
+func (s *DiskStore) SetHash(ctx context.Context, key store.BucketKey, vecId string) error {
+	return s.SetHashes(ctx, map[store.BucketKey][]string{key: {vecId}})
+}
+
+// internalID returns dense id of the vector, assigning the new one if needed
+// NOTE: must be called under the write lock
+func (s *DiskStore) internalID(id string) (uint32, error) {
+	internal, ok := s.ids[id]
+	if ok {
+		return internal, nil
+	}
+	if uint64(len(s.names)) > uint64(^uint32(0)) {
+		return 0, idsOverflowErr
+	}
+	internal = uint32(len(s.names))
+	s.ids[id] = internal
+	s.names = append(s.names, id)
+	return internal, nil
+}
+
+// dropIDs forgets dense ids starting from the given one, when their record wasn't written
+// NOTE: must be called under the write lock
+func (s *DiskStore) dropIDs(from int) {
+	for _, id := range s.names[from:] {
+		delete(s.ids, id)
+	}
+	s.names = s.names[:from]
+}
+
+// SetHashes appends one postings record per bucket, all of them with a single write;
+// new ids are appended to the ids table in the same write, right before the postings which use them
+func (s *DiskStore) SetHashes(ctx context.Context, hashes map[store.BucketKey][]string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.closed {
+		return store.ClosedErr
+	}
+	first := len(s.names)
+	keys := make([]store.BucketKey, 0, len(hashes))
+	bodies := make([][]byte, 1, len(hashes)+1)
+	for key, ids := range hashes {
+		internals := make([]uint32, len(ids))
+		for i, id := range ids {
+			internal, err := s.internalID(id)
+			if err != nil {
+				s.dropIDs(first)
+				return err
+			}
+			internals[i] = internal
+		}
+		keys = append(keys, key)
+		bodies = append(bodies, encodePostingsRecord(key, internals))
+	}
+	if len(s.names) > first {
+		bodies[0] = encodeIdsRecord(first, s.names[first:])
+	} else {
+		bodies = bodies[1:]
+	}
+	refs, err := s.postings.append(bodies...)
+	if err != nil {
+		s.dropIDs(first)
+		return err
+	}
+	refs = refs[len(bodies)-len(keys):]
+	for i, key := range keys {
+		s.addChunk(key, refs[i], len(hashes[key]))
+	}
+	return s.afterWrite(s.postings)
+}
+
+// postingIterator reads bucket chunks from the log lazily, one chunk at a time,
+// and decodes postings blocks of the chunk one block at a time
+type postingIterator struct {
+	s      *DiskStore
+	gen    uint64
+	chunks []recordRef
+	blocks *postings.Iterator
+	names  []string
+	err    error
+}
+
+func (it *postingIterator) load(ref recordRef) error {
+	it.s.mx.RLock()
+	defer it.s.mx.RUnlock()
+	if it.s.closed {
+		return store.ClosedErr
+	}
+	if it.s.gen != it.gen {
+		return storeClearedErr
+	}
+	body, err := it.s.postings.read(ref)
+	if err != nil {
+		return err
+	}
+	_, _, blocks, err := decodePostingsRecord(body)
+	if err != nil {
+		return err
+	}
+	it.blocks = postings.NewIterator(blocks)
+	// NOTE: ids table is append-only until Clear, which is detected by the generation
+	it.names = it.s.names[:len(it.s.names):len(it.s.names)]
+	return nil
+}
+
+func (it *postingIterator) Next() (string, bool) {
+	for it.err == nil {
+		if it.blocks != nil {
+			internal, ok := it.blocks.Next()
+			if ok {
+				if int(internal) >= len(it.names) {
+					it.err = corruptedRecordErr
+					return "", false
+				}
+				return it.names[internal], true
+			}
+			if it.blocks.Err() != nil {
+				it.err = corruptedRecordErr
+				return "", false
+			}
+		}
+		if len(it.chunks) == 0 {
+			return "", false
+		}
+		it.err = it.load(it.chunks[0])
+		it.chunks = it.chunks[1:]
+	}
+	return "", false
+}
+
+func (it *postingIterator) Err() error {
+	return it.err
+}
+
+func (it *postingIterator) Close() error {
+	it.chunks = nil
+	it.blocks = nil
+	it.names = nil
+	return nil
+}
+
+// GetHashIterator returns iterator over the bucket chunks written so far
+func (s *DiskStore) GetHashIterator(ctx context.Context, key store.BucketKey) (store.Iterator, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return nil, store.ClosedErr
+	}
+	bucket, ok := s.buckets[key]
+	if !ok {
+		return nil, store.BucketNotFoundErr
+	}
+	return &postingIterator{
+		s:      s,
+		gen:    s.gen,
+		chunks: bucket.chunks[:len(bucket.chunks):len(bucket.chunks)],
+	}, nil
+}
+
+// GetIdsIterator returns iterator over the snapshot of ids of the stored vectors and codes
+func (s *DiskStore) GetIdsIterator(ctx context.Context) (store.Iterator, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return nil, store.ClosedErr
+	}
+	ids := make([]string, 0, len(s.vecs))
+	for id := range s.vecs {
+		ids = append(ids, id)
+	}
+	for id := range s.codes {
+		if _, ok := s.vecs[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	return store.NewSliceIterator(ids), nil
+}
+
+// GetBucketsSizes returns number of entries in every bucket
+func (s *DiskStore) GetBucketsSizes(ctx context.Context) (map[store.BucketKey]int, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return nil, store.ClosedErr
+	}
+	sizes := make(map[store.BucketKey]int, len(s.buckets))
+	for key, bucket := range s.buckets {
+		sizes[key] = bucket.size
+	}
+	return sizes, nil
+}
+
+// Clear truncates both files
+func (s *DiskStore) Clear(ctx context.Context) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.closed {
+		return store.ClosedErr
+	}
+	err := s.vectors.truncate()
+	if err != nil {
+		return err
+	}
+	err = s.postings.truncate()
+	if err != nil {
+		return err
+	}
+	s.vecs = make(map[string]recordRef)
+	s.codes = make(map[string]recordRef)
+	s.buckets = make(map[store.BucketKey]*bucketIndex)
+	s.ids = make(map[string]uint32)
+	s.names = nil
+	s.gen++
+	err = s.afterWrite(s.vectors)
+	if err != nil {
+		return err
+	}
+	return s.afterWrite(s.postings)
+}
+
+// Sync flushes both files to the disk
+func (s *DiskStore) Sync() error {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if s.closed {
+		return store.ClosedErr
+	}
+	err := s.vectors.sync()
+	if err != nil {
+		return err
+	}
+	return s.postings.sync()
+}
+
+// Close flushes and closes the files, store can't be used after that
+func (s *DiskStore) Close() error {
+	s.mx.Lock()
+	if s.closed {
+		s.mx.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mx.Unlock()
+	close(s.stop)
+	s.wg.Wait()
+	var result error
+	for _, sg := range []*segment{s.vectors, s.postings} {
+		err := sg.sync()
+		if err == nil {
+			err = sg.close()
+		} else {
+			sg.close()
+		}
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
@@ -0,0 +1,268 @@
+package disk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/storetest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDiskStore(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "lsh-disk-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewDiskStore(dir, Options{Sync: SyncEveryWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { s.Close() }()
+	key := store.BucketKey{Tree: 0, Hash: 42}
+	vec := []float64{1, 2.5}
+	err = s.SetVectors(ctx, []string{"0", "3"}, [][]float64{vec, {3, 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetCode(ctx, "0", []byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetHashes(ctx, map[store.BucketKey][]string{key: {"0", "3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetHash(ctx, key, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const bucketSize = 3
+
+	t.Run("Reopen", func(t *testing.T) {
+		err := s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.GetVector(ctx, "0")
+		if !errors.Is(err, store.ClosedErr) {
+			t.Errorf("Closed store must return %v, got %v", store.ClosedErr, err)
+		}
+		s, err = NewDiskStore(dir, Options{Sync: SyncInterval})
+		if err != nil {
+			t.Fatal(err)
+		}
+		vecReturned, err := s.GetVector(ctx, "3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual([]float64{3, 4}, vecReturned) {
+			t.Errorf("Vector must survive reopening, got %v", vecReturned)
+		}
+		code, err := s.GetCode(ctx, "0")
+		if err != nil || !reflect.DeepEqual(code, []byte{1, 2, 3}) {
+			t.Error("Code must survive reopening")
+		}
+		ids, err := storetest.ReadBucket(ctx, s, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != bucketSize {
+			t.Errorf("Wrong bucket after reopening: %v", ids)
+		}
+	})
+
+	t.Run("TornWrite", func(t *testing.T) {
+		err := s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// NOTE: imitate the write interrupted in the middle of the record,
+		// garbage length of the postings record must be checked before the body allocation
+		torn := map[string][]byte{
+			vectorsFileName:  {100, 0, 0, 0, 1, 2},
+			postingsFileName: {0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4, 5},
+		}
+		for name, tail := range torn {
+			f, err := os.OpenFile(filepath.Join(dir, name), os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(tail)
+			f.Close()
+		}
+		s, err = NewDiskStore(dir, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.SetVector(ctx, "4", vec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.SetHash(ctx, key, "4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+		s, err = NewDiskStore(dir, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.GetVector(ctx, "4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := storetest.ReadBucket(ctx, s, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != bucketSize+1 {
+			t.Errorf("Wrong bucket after the torn write: %v", ids)
+		}
+	})
+
+	t.Run("CorruptedRecord", func(t *testing.T) {
+		err := s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, vectorsFileName)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// NOTE: flip a byte in the body of the first record
+		data[recordHeaderSize+1] ^= 0xff
+		err = ioutil.WriteFile(path, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = NewDiskStore(dir, Options{})
+		if err != corruptedRecordErr {
+			t.Fatalf("Broken record in the middle must fail opening, got %v", err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(len(data)) {
+			t.Fatal("Records after the broken one must not be truncated")
+		}
+		data[recordHeaderSize+1] ^= 0xff
+		err = ioutil.WriteFile(path, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err = NewDiskStore(dir, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.GetVector(ctx, "4")
+		if err != nil {
+			t.Errorf("Last record must survive, got %v", err)
+		}
+	})
+
+	t.Run("Clear", func(t *testing.T) {
+		it, err := s.GetHashIterator(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+		s.Clear(ctx)
+		_, err = s.GetVector(ctx, "0")
+		if !errors.Is(err, store.KeyNotFoundErr) {
+			t.Errorf("Vector must be removed, got %v", err)
+		}
+		_, ok := it.Next()
+		if ok || it.Err() == nil {
+			t.Error("Iterator must fail after the store was cleared")
+		}
+		sizes, err := s.GetBucketsSizes(ctx)
+		if err != nil || len(sizes) != 0 {
+			t.Errorf("Buckets must be removed: %v", sizes)
+		}
+	})
+}
+
+func TestDiskStorePostings(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "lsh-disk-postings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewDiskStore(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { s.Close() }()
+	const nTrees = 10
+	ids := make([]string, 1000)
+	idsSize := 0
+	for i := range ids {
+		ids[i] = fmt.Sprintf("vector-%v", i)
+		idsSize += len(ids[i])
+	}
+	hashes := make(map[store.BucketKey][]string)
+	for tree := 0; tree < nTrees; tree++ {
+		hashes[store.BucketKey{Tree: tree}] = ids
+	}
+	err = s.SetHashes(ctx, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, postingsFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NOTE: string ids are written once, postings of the dense ids take a few bytes per tree
+	if info.Size() > int64(2*idsSize) {
+		t.Errorf("Postings must be compressed, got %v bytes", info.Size())
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = NewDiskStore(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key := range hashes {
+		read, err := storetest.ReadBucket(ctx, s, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := append([]string{}, ids...)
+		sort.Strings(expected)
+		if !reflect.DeepEqual(read, expected) {
+			t.Fatalf("Wrong bucket %v after reopening", key)
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	root, err := ioutil.TempDir("", "lsh-disk-conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	storetest.RunConformance(t, func() store.Store {
+		dir, err := ioutil.TempDir(root, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewDiskStore(dir, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
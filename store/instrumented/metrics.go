@@ -0,0 +1,182 @@
+package instrumented
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// HistogramBuckets is a number of the latency buckets, every next bound is twice the previous one,
+	// starting from the HistogramBase; slower calls are counted in the extra overflow bucket
+	HistogramBuckets = 24
+	HistogramBase    = time.Microsecond
+)
+
+// Store methods which are instrumented; IteratorNext counts the single calls of the iterators Next
+const (
+	SetVector       = "SetVector"
+	SetVectors      = "SetVectors"
+	GetVector       = "GetVector"
+	SetCode         = "SetCode"
+	SetCodes        = "SetCodes"
+	GetCode         = "GetCode"
+	SetHash         = "SetHash"
+	SetHashes       = "SetHashes"
+	GetHashIterator = "GetHashIterator"
+	IteratorNext    = "IteratorNext"
+	GetBucketsSizes = "GetBucketsSizes"
+	GetIdsIterator  = "GetIdsIterator"
+	Clear           = "Clear"
+)
+
+type method int
+
+const (
+	setVector method = iota
+	setVectors
+	getVector
+	setCode
+	setCodes
+	getCode
+	setHash
+	setHashes
+	getHashIterator
+	iteratorNext
+	getBucketsSizes
+	getIdsIterator
+	clearStore
+	methodsNumber
+)
+
+var methodNames = [methodsNumber]string{
+	SetVector, SetVectors, GetVector,
+	SetCode, SetCodes, GetCode,
+	SetHash, SetHashes, GetHashIterator, IteratorNext,
+	GetBucketsSizes, GetIdsIterator, Clear,
+}
+
+// methodMetrics holds counters of a single method, updated atomically
+type methodMetrics struct {
+	calls   uint64
+	errors  uint64
+	misses  uint64
+	bytes   uint64
+	nanos   uint64
+	latency [HistogramBuckets + 1]uint64
+}
+
+// latencyBucket returns index of the smallest bound, which is not less than d
+func latencyBucket(d time.Duration) int {
+	bound := HistogramBase
+	for i := 0; i < HistogramBuckets; i++ {
+		if d <= bound {
+			return i
+		}
+		bound *= 2
+	}
+	return HistogramBuckets
+}
+
+func (m *methodMetrics) observe(elapsed time.Duration, bytes int, err, miss bool) {
+	atomic.AddUint64(&m.calls, 1)
+	if err {
+		atomic.AddUint64(&m.errors, 1)
+	}
+	if miss {
+		atomic.AddUint64(&m.misses, 1)
+	}
+	atomic.AddUint64(&m.bytes, uint64(bytes))
+	atomic.AddUint64(&m.nanos, uint64(elapsed))
+	atomic.AddUint64(&m.latency[latencyBucket(elapsed)], 1)
+}
+
+func (m *methodMetrics) snapshot() MethodStats {
+	stats := MethodStats{
+		Calls:  atomic.LoadUint64(&m.calls),
+		Errors: atomic.LoadUint64(&m.errors),
+		Misses: atomic.LoadUint64(&m.misses),
+		Bytes:  atomic.LoadUint64(&m.bytes),
+		Latency: Histogram{
+			Total:  time.Duration(atomic.LoadUint64(&m.nanos)),
+			Counts: make([]uint64, len(m.latency)),
+		},
+	}
+	for i := range m.latency {
+		stats.Latency.Counts[i] = atomic.LoadUint64(&m.latency[i])
+	}
+	return stats
+}
+
+// Histogram holds number of calls per latency bucket, see HistogramBuckets
+type Histogram struct {
+	Total  time.Duration
+	Counts []uint64
+}
+
+// Bound returns upper bound of the i-th bucket, the overflow bucket has no bound
+func (h Histogram) Bound(i int) (time.Duration, bool) {
+	if i >= HistogramBuckets {
+		return 0, false
+	}
+	return HistogramBase << uint(i), true
+}
+
+// Mean returns average latency of the call
+func (h Histogram) Mean() time.Duration {
+	var calls uint64
+	for _, c := range h.Counts {
+		calls += c
+	}
+	if calls == 0 {
+		return 0
+	}
+	return h.Total / time.Duration(calls)
+}
+
+// Quantile returns upper bound of the bucket which holds the q-th quantile,
+// NOTE: calls from the overflow bucket are reported with the largest bound
+func (h Histogram) Quantile(q float64) time.Duration {
+	var calls uint64
+	for _, c := range h.Counts {
+		calls += c
+	}
+	if calls == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(calls))
+	var seen uint64
+	for i, c := range h.Counts {
+		seen += c
+		if seen > rank {
+			if bound, ok := h.Bound(i); ok {
+				return bound
+			}
+			break
+		}
+	}
+	bound, _ := h.Bound(HistogramBuckets - 1)
+	return bound
+}
+
+// MethodStats holds counters of a single store method;
+// Misses are the not found keys and buckets, which are not counted as Errors,
+// Bytes are the sizes of vectors, codes and ids passed to or returned from the store
+type MethodStats struct {
+	Calls   uint64
+	Errors  uint64
+	Misses  uint64
+	Bytes   uint64
+	Latency Histogram
+}
+
+// Snapshot holds stats of every method by its name
+type Snapshot map[string]MethodStats
+
+// Total returns time spent in all methods of the store
+func (s Snapshot) Total() time.Duration {
+	var total time.Duration
+	for _, stats := range s {
+		total += stats.Latency.Total
+	}
+	return total
+}
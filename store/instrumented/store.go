@@ -0,0 +1,203 @@
+package instrumented
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"github.com/gasparian/lsh-search-go/store"
+	"io"
+	"time"
+)
+
+const float64Size = 8
+
+// Store is the instrumented store, which reports metrics of the wrapped one
+type Store interface {
+	store.Store
+	io.Closer
+	Snapshot() Snapshot
+	Publish(name string)
+}
+
+// InstrumentedStore records calls, errors, bytes and latency of every method of the wrapped store
+type InstrumentedStore struct {
+	store   store.Store
+	metrics [methodsNumber]methodMetrics
+}
+
+// instrumentedCodeStore keeps codes methods of the wrapped store
+type instrumentedCodeStore struct {
+	*InstrumentedStore
+	codes store.CodeStore
+}
+
+// NewInstrumentedStore wraps the store, codes methods are kept
+// when the wrapped store implements them
+func NewInstrumentedStore(s store.Store) Store {
+	instrumented := &InstrumentedStore{store: s}
+	if codes, ok := s.(store.CodeStore); ok {
+		return &instrumentedCodeStore{
+			InstrumentedStore: instrumented,
+			codes:             codes,
+		}
+	}
+	return instrumented
+}
+
+// Snapshot returns current values of the counters
+func (s *InstrumentedStore) Snapshot() Snapshot {
+	snapshot := make(Snapshot, methodsNumber)
+	for i := range s.metrics {
+		snapshot[methodNames[i]] = s.metrics[i].snapshot()
+	}
+	return snapshot
+}
+
+// Publish exposes snapshot as the expvar variable,
+// NOTE: expvar panics when the name is already published
+func (s *InstrumentedStore) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return s.Snapshot()
+	}))
+}
+
+// observe records the call started at start, not found errors are counted as misses
+func (s *InstrumentedStore) observe(m method, start time.Time, bytes int, err error) {
+	miss := errors.Is(err, store.KeyNotFoundErr) || errors.Is(err, store.BucketNotFoundErr)
+	s.metrics[m].observe(time.Since(start), bytes, err != nil && !miss, miss)
+}
+
+func idsSize(ids []string) int {
+	size := 0
+	for _, id := range ids {
+		size += len(id)
+	}
+	return size
+}
+
+func (s *InstrumentedStore) SetVector(ctx context.Context, id string, vec []float64) error {
+	start := time.Now()
+	err := s.store.SetVector(ctx, id, vec)
+	s.observe(setVector, start, len(vec)*float64Size, err)
+	return err
+}
+
+func (s *InstrumentedStore) SetVectors(ctx context.Context, ids []string, vecs [][]float64) error {
+	start := time.Now()
+	err := s.store.SetVectors(ctx, ids, vecs)
+	size := 0
+	for _, vec := range vecs {
+		size += len(vec) * float64Size
+	}
+	s.observe(setVectors, start, size, err)
+	return err
+}
+
+func (s *InstrumentedStore) GetVector(ctx context.Context, id string) ([]float64, error) {
+	start := time.Now()
+	vec, err := s.store.GetVector(ctx, id)
+	s.observe(getVector, start, len(vec)*float64Size, err)
+	return vec, err
+}
+
+func (s *InstrumentedStore) SetHash(ctx context.Context, key store.BucketKey, vecId string) error {
+	start := time.Now()
+	err := s.store.SetHash(ctx, key, vecId)
+	s.observe(setHash, start, len(vecId), err)
+	return err
+}
+
+func (s *InstrumentedStore) SetHashes(ctx context.Context, hashes map[store.BucketKey][]string) error {
+	start := time.Now()
+	err := s.store.SetHashes(ctx, hashes)
+	size := 0
+	for _, ids := range hashes {
+		size += idsSize(ids)
+	}
+	s.observe(setHashes, start, size, err)
+	return err
+}
+
+// iterator records every Next call, the failed iteration is counted as an error of the last call
+type iterator struct {
+	store.Iterator
+	s *InstrumentedStore
+}
+
+func (it *iterator) Next() (string, bool) {
+	start := time.Now()
+	id, ok := it.Iterator.Next()
+	var err error
+	if !ok {
+		err = it.Iterator.Err()
+	}
+	it.s.observe(iteratorNext, start, len(id), err)
+	return id, ok
+}
+
+func (s *InstrumentedStore) GetHashIterator(ctx context.Context, key store.BucketKey) (store.Iterator, error) {
+	start := time.Now()
+	it, err := s.store.GetHashIterator(ctx, key)
+	s.observe(getHashIterator, start, 0, err)
+	if err != nil {
+		return nil, err
+	}
+	return &iterator{Iterator: it, s: s}, nil
+}
+
+func (s *InstrumentedStore) GetBucketsSizes(ctx context.Context) (map[store.BucketKey]int, error) {
+	start := time.Now()
+	sizes, err := s.store.GetBucketsSizes(ctx)
+	s.observe(getBucketsSizes, start, 0, err)
+	return sizes, err
+}
+
+func (s *InstrumentedStore) GetIdsIterator(ctx context.Context) (store.Iterator, error) {
+	start := time.Now()
+	it, err := s.store.GetIdsIterator(ctx)
+	s.observe(getIdsIterator, start, 0, err)
+	if err != nil {
+		return nil, err
+	}
+	return &iterator{Iterator: it, s: s}, nil
+}
+
+func (s *InstrumentedStore) Clear(ctx context.Context) error {
+	start := time.Now()
+	err := s.store.Clear(ctx)
+	s.observe(clearStore, start, 0, err)
+	return err
+}
+
+func (s *instrumentedCodeStore) SetCode(ctx context.Context, id string, code []byte) error {
+	start := time.Now()
+	err := s.codes.SetCode(ctx, id, code)
+	s.observe(setCode, start, len(code), err)
+	return err
+}
+
+func (s *instrumentedCodeStore) SetCodes(ctx context.Context, ids []string, codes [][]byte) error {
+	start := time.Now()
+	err := s.codes.SetCodes(ctx, ids, codes)
+	size := 0
+	for _, code := range codes {
+		size += len(code)
+	}
+	s.observe(setCodes, start, size, err)
+	return err
+}
+
+func (s *instrumentedCodeStore) GetCode(ctx context.Context, id string) ([]byte, error) {
+	start := time.Now()
+	code, err := s.codes.GetCode(ctx, id)
+	s.observe(getCode, start, len(code), err)
+	return code, err
+}
+
+// Close closes the wrapped store, when it needs closing
+func (s *InstrumentedStore) Close() error {
+	if closer, ok := s.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package instrumented
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/kv"
+	"github.com/gasparian/lsh-search-go/store/storetest"
+	"testing"
+	"time"
+)
+
+// singleStore has no codes methods
+type singleStore struct {
+	store.Store
+}
+
+// closingStore tracks Close calls
+type closingStore struct {
+	*kv.KVStore
+	closed bool
+}
+
+func (s *closingStore) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestInstrumentedStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewInstrumentedStore(kv.NewKVStore())
+	key := store.BucketKey{Tree: 0, Hash: 42}
+
+	t.Run("Counters", func(t *testing.T) {
+		err := s.SetVectors(ctx, []string{"a", "b"}, [][]float64{{1, 2}, {3, 4}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.SetHashes(ctx, map[store.BucketKey][]string{key: {"a", "b"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.GetVector(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.GetVector(ctx, "c")
+		if !errors.Is(err, store.KeyNotFoundErr) {
+			t.Fatalf("Wrapped store error must be returned, got %v", err)
+		}
+		err = s.SetVectors(ctx, []string{"a"}, nil)
+		if err == nil {
+			t.Fatal("Batch with different number of ids and vectors must return an error")
+		}
+		it, err := s.GetHashIterator(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ok := it.Next(); ok; _, ok = it.Next() {
+		}
+		it.Close()
+
+		snapshot := s.Snapshot()
+		if len(snapshot) != int(methodsNumber) {
+			t.Errorf("Snapshot must hold every method, got %v", len(snapshot))
+		}
+		setVectors := snapshot[SetVectors]
+		if setVectors.Calls != 2 || setVectors.Errors != 1 || setVectors.Bytes != 32 {
+			t.Errorf("Wrong SetVectors stats: %+v", setVectors)
+		}
+		getVector := snapshot[GetVector]
+		if getVector.Calls != 2 || getVector.Misses != 1 || getVector.Errors != 0 || getVector.Bytes != 16 {
+			t.Errorf("Wrong GetVector stats: %+v", getVector)
+		}
+		if snapshot[SetHashes].Bytes != 2 {
+			t.Errorf("Wrong SetHashes stats: %+v", snapshot[SetHashes])
+		}
+		// NOTE: the last Next call reports the end of the bucket
+		if snapshot[IteratorNext].Calls != 3 || snapshot[IteratorNext].Bytes != 2 {
+			t.Errorf("Wrong IteratorNext stats: %+v", snapshot[IteratorNext])
+		}
+		var calls uint64
+		for _, c := range getVector.Latency.Counts {
+			calls += c
+		}
+		if calls != getVector.Calls {
+			t.Errorf("Histogram must count every call, got %v", calls)
+		}
+	})
+
+	t.Run("CodeStore", func(t *testing.T) {
+		codes, ok := s.(store.CodeStore)
+		if !ok {
+			t.Fatal("Wrapped code store must stay the code store")
+		}
+		err := codes.SetCode(ctx, "a", []byte{1, 2, 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Snapshot()[SetCode].Bytes != 3 {
+			t.Errorf("Wrong SetCode stats: %+v", s.Snapshot()[SetCode])
+		}
+		_, ok = NewInstrumentedStore(singleStore{kv.NewKVStore()}).(store.CodeStore)
+		if ok {
+			t.Error("Store without codes must not become the code store")
+		}
+	})
+
+	t.Run("Publish", func(t *testing.T) {
+		s.Publish("lsh-instrumented-test")
+		published := expvar.Get("lsh-instrumented-test")
+		if published == nil {
+			t.Fatal("Snapshot must be published")
+		}
+		var snapshot Snapshot
+		err := json.Unmarshal([]byte(published.String()), &snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if snapshot[GetVector].Calls != s.Snapshot()[GetVector].Calls {
+			t.Errorf("Wrong published stats: %+v", snapshot[GetVector])
+		}
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		wrapped := &closingStore{KVStore: kv.NewKVStore()}
+		err := NewInstrumentedStore(wrapped).Close()
+		if err != nil || !wrapped.closed {
+			t.Errorf("Wrapped store must be closed, got %v", err)
+		}
+		err = s.Close()
+		if err != nil {
+			t.Errorf("Store without Close must be closed silently, got %v", err)
+		}
+	})
+}
+
+func TestHistogram(t *testing.T) {
+	if latencyBucket(0) != 0 || latencyBucket(HistogramBase) != 0 || latencyBucket(HistogramBase+1) != 1 {
+		t.Error("Wrong bucket of the small latency")
+	}
+	if latencyBucket(time.Hour) != HistogramBuckets {
+		t.Error("Slow call must be counted in the overflow bucket")
+	}
+	h := Histogram{Total: 10 * time.Microsecond, Counts: make([]uint64, HistogramBuckets+1)}
+	h.Counts[0] = 8
+	h.Counts[3] = 2
+	if h.Mean() != time.Microsecond {
+		t.Errorf("Wrong mean: %v", h.Mean())
+	}
+	if h.Quantile(0.5) != HistogramBase || h.Quantile(0.9) != 8*HistogramBase {
+		t.Errorf("Wrong quantiles: %v, %v", h.Quantile(0.5), h.Quantile(0.9))
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func() store.Store {
+		return NewInstrumentedStore(kv.NewKVStore())
+	})
+}
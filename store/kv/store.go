@@ -1,101 +1,159 @@
 package kv
 
 import (
-	"errors"
-	"fmt"
+	"context"
 	"github.com/gasparian/lsh-search-go/store"
 	guuid "github.com/google/uuid"
 	"sync"
 )
 
-var (
-	bucketNotFoundErr = errors.New("Bucket not found")
-	keyNotFoundErr    = errors.New("Key not found")
-)
-
 type KVStore struct {
-	mx sync.RWMutex
-	m  map[string]map[string]interface{}
+	mx      sync.RWMutex
+	vecs    map[string][]float64
+	codes   map[string][]byte
+	buckets map[store.BucketKey]map[string]string
 }
 
 func NewKVStore() *KVStore {
 	return &KVStore{
-		m: make(map[string]map[string]interface{}),
+		vecs:    make(map[string][]float64),
+		codes:   make(map[string][]byte),
+		buckets: make(map[store.BucketKey]map[string]string),
 	}
 }
 
-type KeysIterator struct {
-	vecIds chan string
+func (s *KVStore) SetVector(ctx context.Context, id string, vec []float64) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.vecs[id] = vec
+	return nil
 }
 
-func (it *KeysIterator) Next() (string, bool) {
-	vecId, opened := <-it.vecIds
-	if !opened {
-		return "", false
+func (s *KVStore) SetVectors(ctx context.Context, ids []string, vecs [][]float64) error {
+	if len(ids) != len(vecs) {
+		return store.BatchLengthErr
 	}
-	return vecId, true
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for i, id := range ids {
+		s.vecs[id] = vecs[i]
+	}
+	return nil
 }
 
-func getBucketName(perm int, hash uint64) string {
-	return fmt.Sprintf("%v_%v", perm, hash)
+func (s *KVStore) GetVector(ctx context.Context, id string) ([]float64, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	vec, ok := s.vecs[id]
+	if !ok {
+		return nil, store.KeyNotFoundErr
+	}
+	return vec, nil
+}
+
+func (s *KVStore) SetCode(ctx context.Context, id string, code []byte) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.codes[id] = code
+	return nil
 }
 
-func (s *KVStore) SetVector(id string, vec []float64) error {
+func (s *KVStore) SetCodes(ctx context.Context, ids []string, codes [][]byte) error {
+	if len(ids) != len(codes) {
+		return store.BatchLengthErr
+	}
 	s.mx.Lock()
 	defer s.mx.Unlock()
-	if _, ok := s.m["vec"]; !ok {
-		s.m["vec"] = make(map[string]interface{})
+	for i, id := range ids {
+		s.codes[id] = codes[i]
 	}
-	s.m["vec"][id] = vec
 	return nil
 }
 
-func (s *KVStore) GetVector(id string) ([]float64, error) {
+func (s *KVStore) GetCode(ctx context.Context, id string) ([]byte, error) {
 	s.mx.RLock()
 	defer s.mx.RUnlock()
-	vecTmp, ok := s.m["vec"][id]
+	code, ok := s.codes[id]
 	if !ok {
-		return nil, keyNotFoundErr
+		return nil, store.KeyNotFoundErr
 	}
-	vec := vecTmp.([]float64)
-	return vec, nil
+	return code, nil
 }
 
-func (s *KVStore) SetHash(bucketName, vecId string) error {
+func (s *KVStore) SetHash(ctx context.Context, key store.BucketKey, vecId string) error {
 	s.mx.Lock()
 	defer s.mx.Unlock()
-	if _, ok := s.m[bucketName]; !ok {
-		s.m[bucketName] = make(map[string]interface{})
+	if _, ok := s.buckets[key]; !ok {
+		s.buckets[key] = make(map[string]string)
 	}
 	uid := guuid.NewString()
-	s.m[bucketName][uid] = vecId
+	s.buckets[key][uid] = vecId
 	return nil
 }
 
-func (s *KVStore) GetHashIterator(bucketName string) (store.Iterator, error) {
+func (s *KVStore) SetHashes(ctx context.Context, hashes map[store.BucketKey][]string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for key, vecIds := range hashes {
+		if _, ok := s.buckets[key]; !ok {
+			s.buckets[key] = make(map[string]string)
+		}
+		for _, vecId := range vecIds {
+			s.buckets[key][guuid.NewString()] = vecId
+		}
+	}
+	return nil
+}
+
+func (s *KVStore) GetHashIterator(ctx context.Context, key store.BucketKey) (store.Iterator, error) {
 	s.mx.RLock()
 	defer s.mx.RUnlock()
 
-	bucket, ok := s.m[bucketName]
+	bucket, ok := s.buckets[key]
 	if !ok {
-		return nil, bucketNotFoundErr
+		return nil, store.BucketNotFoundErr
+	}
+	ids := make([]string, 0, len(bucket))
+	for _, v := range bucket {
+		ids = append(ids, v)
 	}
-	hashCh := make(chan string)
-	go func() {
-		for _, v := range bucket {
-			hashCh <- v.(string)
+	return store.NewSliceIterator(ids), nil
+}
+
+// GetIdsIterator returns iterator over the snapshot of ids of the stored vectors and codes
+func (s *KVStore) GetIdsIterator(ctx context.Context) (store.Iterator, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	ids := make([]string, 0, len(s.vecs))
+	for id := range s.vecs {
+		ids = append(ids, id)
+	}
+	for id := range s.codes {
+		if _, ok := s.vecs[id]; !ok {
+			ids = append(ids, id)
 		}
-		close(hashCh)
-	}()
-	it := &KeysIterator{
-		vecIds: hashCh,
 	}
-	return it, nil
+	return store.NewSliceIterator(ids), nil
+}
+
+// GetBucketsSizes returns number of entries in every bucket
+func (s *KVStore) GetBucketsSizes(ctx context.Context) (map[store.BucketKey]int, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	sizes := make(map[store.BucketKey]int, len(s.buckets))
+	for key, bucket := range s.buckets {
+		sizes[key] = len(bucket)
+	}
+	return sizes, nil
 }
 
-func (s *KVStore) Clear() error {
+func (s *KVStore) Clear(ctx context.Context) error {
 	s.mx.Lock()
 	defer s.mx.Unlock()
-	s.m = make(map[string]map[string]interface{})
+	s.vecs = make(map[string][]float64)
+	s.codes = make(map[string][]byte)
+	s.buckets = make(map[store.BucketKey]map[string]string)
 	return nil
 }
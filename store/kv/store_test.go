@@ -1,7 +1,10 @@
 package kv
 
 import (
+	"context"
 	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/storetest"
 	"reflect"
 	"testing"
 )
@@ -15,7 +18,9 @@ var (
 )
 
 func TestKvStore(t *testing.T) {
-	store := NewKVStore()
+	ctx := context.Background()
+	s := NewKVStore()
+	key := store.BucketKey{Tree: 0, Hash: 42}
 	vecIds := map[string]bool{
 		"0": true,
 		"1": true,
@@ -24,12 +29,12 @@ func TestKvStore(t *testing.T) {
 
 	t.Run("SetVector", func(t *testing.T) {
 		for k := range vecIds {
-			err := store.SetVector(k, vec)
+			err := s.SetVector(ctx, k, vec)
 			if err != nil {
 				t.Fatal(err)
 			}
 		}
-		vecReturned, err := store.GetVector("0")
+		vecReturned, err := s.GetVector(ctx, "0")
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -38,15 +43,30 @@ func TestKvStore(t *testing.T) {
 		}
 	})
 
+	t.Run("SetCode", func(t *testing.T) {
+		code := []byte{1, 2, 3}
+		err := s.SetCode(ctx, "0", code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codeReturned, err := s.GetCode(ctx, "0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(code, codeReturned) {
+			t.Error(vectorsAreNotEqualErr)
+		}
+	})
+
 	t.Run("SetHash", func(t *testing.T) {
 		for k := range vecIds {
-			err := store.SetHash("0", k)
+			err := s.SetHash(ctx, key, k)
 			if err != nil {
 				t.Fatal(err)
 			}
 		}
 
-		it, err := store.GetHashIterator("0")
+		it, err := s.GetHashIterator(ctx, key)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -64,13 +84,84 @@ func TestKvStore(t *testing.T) {
 		if ok {
 			t.Error(iteratorNotClosedErr)
 		}
+		if it.Err() != nil {
+			t.Error(it.Err())
+		}
+		if it.Close() != nil {
+			t.Error("Iterator must be closed without errors")
+		}
+
+		// NOTE: iterator holds the snapshot, so it's not affected by the following writes
+		snapshotKey := store.BucketKey{Tree: 2, Hash: 0}
+		s.SetHash(ctx, snapshotKey, "0")
+		it, err = s.GetHashIterator(ctx, snapshotKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetHash(ctx, snapshotKey, "1")
+		n := 0
+		for _, ok := it.Next(); ok; _, ok = it.Next() {
+			n++
+		}
+		it.Close()
+		if n != 1 {
+			t.Errorf("Iterator must return only ids from the snapshot, got %v", n)
+		}
+	})
+
+	t.Run("GetBucketsSizes", func(t *testing.T) {
+		sizes, err := s.GetBucketsSizes(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sizes[key] != len(vecIds) {
+			t.Errorf("Expected bucket with %v entries, got %v", len(vecIds), sizes)
+		}
+	})
+
+	t.Run("SetBatches", func(t *testing.T) {
+		batchKey := store.BucketKey{Tree: 1, Hash: 1}
+		err := s.SetVectors(ctx, []string{"2", "3"}, [][]float64{vec, vec})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.SetVectors(ctx, []string{"4"}, nil)
+		if err == nil {
+			t.Error("Batch with different number of ids and vectors must fail")
+		}
+		err = s.SetCodes(ctx, []string{"2"}, [][]byte{{1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.SetHashes(ctx, map[store.BucketKey][]string{batchKey: {"2", "3"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		vecReturned, err := s.GetVector(ctx, "3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vec, vecReturned) {
+			t.Error(vectorsAreNotEqualErr)
+		}
+		sizes, err := s.GetBucketsSizes(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sizes[batchKey] != 2 {
+			t.Errorf("Expected 2 entries in the bucket, got %v", sizes[batchKey])
+		}
 	})
 
 	t.Run("Clear", func(t *testing.T) {
-		store.Clear()
-		_, err := store.GetVector("0")
+		s.Clear(ctx)
+		_, err := s.GetVector(ctx, "0")
 		if err == nil {
 			t.Error(vectorShouldNotExistErr)
 		}
 	})
 }
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func() store.Store { return NewKVStore() })
+}
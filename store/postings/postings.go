@@ -0,0 +1,317 @@
+// Package postings holds compressed posting lists of the dense uint32 ids:
+// ids are grouped into blocks of up to BlockSize sorted ids, every block is stored either
+// as delta-encoded varints or, for the dense blocks, as a bitmap, and iterators decode one block at a time.
+package postings
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sort"
+)
+
+var (
+	CorruptedErr = errors.New("Posting list is corrupted")
+)
+
+const (
+	// BlockSize is a max number of ids in a single block
+	BlockSize = 128
+
+	varintBlock byte = 0
+	bitmapBlock byte = 1
+
+	// listOverhead is an approximate size of the List struct
+	listOverhead = 80
+)
+
+// List is an append-only compressed posting list; ids appended in the ascending order
+// are encoded right away, the out-of-order id re-encodes only the last (open) block.
+// NOTE: ids are sorted within blocks, but not across them, duplicates are kept.
+// List isn't safe for concurrent writes, but iterators could be used while the list is written under the lock
+type List struct {
+	sealed []byte
+	// NOTE: open block is the varint block, which payload is never modified in place,
+	// so iterators could keep reading its prefix
+	first   uint32
+	last    uint32
+	n       int
+	payload []byte
+	size    int
+}
+
+// NewList creates empty list
+func NewList() *List {
+	return &List{}
+}
+
+// Len returns number of ids in the list
+func (l *List) Len() int {
+	return l.size
+}
+
+// SizeBytes estimates memory used by the list
+func (l *List) SizeBytes() int {
+	return listOverhead + cap(l.sealed) + cap(l.payload)
+}
+
+// Add appends id to the list
+func (l *List) Add(id uint32) {
+	l.size++
+	switch {
+	case l.n == 0:
+		l.first, l.last, l.n = id, id, 1
+		l.payload = nil
+	case id >= l.last:
+		l.payload = appendUvarint(l.payload, uint64(id-l.last))
+		l.last = id
+		l.n++
+	default:
+		ids := decodeVarints(l.first, l.n, l.payload, make([]uint32, 0, l.n+1))
+		i := sort.Search(len(ids), func(i int) bool { return ids[i] > id })
+		ids = append(ids, 0)
+		copy(ids[i+1:], ids[i:])
+		ids[i] = id
+		l.first, l.last, l.n = ids[0], ids[len(ids)-1], len(ids)
+		l.payload = encodeDeltas(nil, ids)
+	}
+	if l.n == BlockSize {
+		l.seal()
+	}
+}
+
+// seal moves the open block to the sealed part, choosing the smallest encoding
+func (l *List) seal() {
+	if l.n == 0 {
+		return
+	}
+	ids := decodeVarints(l.first, l.n, l.payload, make([]uint32, 0, l.n))
+	l.sealed = AppendBlock(l.sealed, ids)
+	l.n = 0
+	l.payload = nil
+}
+
+// AppendBinary appends the whole list in the serialized form, which is read by NewIterator
+func (l *List) AppendBinary(buf []byte) []byte {
+	buf = append(buf, l.sealed...)
+	if l.n > 0 {
+		ids := decodeVarints(l.first, l.n, l.payload, make([]uint32, 0, l.n))
+		buf = AppendBlock(buf, ids)
+	}
+	return buf
+}
+
+// Iterator returns iterator over the current state of the list
+func (l *List) Iterator() *Iterator {
+	it := NewIterator(l.sealed[:len(l.sealed):len(l.sealed)])
+	if l.n > 0 {
+		it.open = true
+		it.openFirst = l.first
+		it.openN = l.n
+		it.openPayload = l.payload[:len(l.payload):len(l.payload)]
+	}
+	return it
+}
+
+// Ids decodes the whole list
+func (l *List) Ids() []uint32 {
+	ids := make([]uint32, 0, l.size)
+	it := l.Iterator()
+	for id, ok := it.Next(); ok; id, ok = it.Next() {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// encodeDeltas appends deltas between the sorted ids, the first id is kept separately
+func encodeDeltas(buf []byte, ids []uint32) []byte {
+	for i := 1; i < len(ids); i++ {
+		buf = appendUvarint(buf, uint64(ids[i]-ids[i-1]))
+	}
+	return buf
+}
+
+// decodeVarints decodes the trusted payload of the open block
+func decodeVarints(first uint32, n int, payload []byte, ids []uint32) []uint32 {
+	ids = append(ids, first)
+	prev := first
+	for len(ids) < n {
+		delta, size := binary.Uvarint(payload)
+		payload = payload[size:]
+		prev += uint32(delta)
+		ids = append(ids, prev)
+	}
+	return ids
+}
+
+// AppendBlock encodes sorted ids as a single block: kind, count, first id, payload length and payload;
+// bitmap is chosen when it's smaller than varints and ids have no duplicates
+func AppendBlock(buf []byte, ids []uint32) []byte {
+	deltas := encodeDeltas(nil, ids)
+	span := uint64(ids[len(ids)-1]-ids[0]) + 1
+	bitmapSize := int((span + 7) / 8)
+	kind := varintBlock
+	if bitmapSize < len(deltas) && !hasDuplicates(ids) {
+		kind = bitmapBlock
+	}
+	buf = append(buf, kind)
+	buf = appendUvarint(buf, uint64(len(ids)))
+	buf = appendUvarint(buf, uint64(ids[0]))
+	if kind == varintBlock {
+		buf = appendUvarint(buf, uint64(len(deltas)))
+		return append(buf, deltas...)
+	}
+	buf = appendUvarint(buf, uint64(bitmapSize))
+	bitmap := make([]byte, bitmapSize)
+	for _, id := range ids {
+		offset := id - ids[0]
+		bitmap[offset/8] |= 1 << (offset % 8)
+	}
+	return append(buf, bitmap...)
+}
+
+// AppendIds encodes sorted ids by blocks of BlockSize
+func AppendIds(buf []byte, ids []uint32) []byte {
+	for len(ids) > 0 {
+		n := BlockSize
+		if n > len(ids) {
+			n = len(ids)
+		}
+		buf = AppendBlock(buf, ids[:n])
+		ids = ids[n:]
+	}
+	return buf
+}
+
+func hasDuplicates(ids []uint32) bool {
+	for i := 1; i < len(ids); i++ {
+		if ids[i] == ids[i-1] {
+			return true
+		}
+	}
+	return false
+}
+
+// Iterator decodes blocks lazily, one block per BlockSize ids
+type Iterator struct {
+	data        []byte
+	buf         []uint32
+	pos         int
+	err         error
+	open        bool
+	openFirst   uint32
+	openN       int
+	openPayload []byte
+}
+
+// NewIterator creates iterator over the serialized blocks
+func NewIterator(data []byte) *Iterator {
+	return &Iterator{data: data}
+}
+
+// Next returns the next id, false means the end of the list or the corrupted data
+func (it *Iterator) Next() (uint32, bool) {
+	for it.pos >= len(it.buf) {
+		if it.err != nil {
+			return 0, false
+		}
+		if len(it.data) > 0 {
+			it.err = it.decodeBlock()
+			if it.err != nil {
+				// NOTE: ids of the previous block must not be returned again
+				it.buf = it.buf[:0]
+				it.pos = 0
+				return 0, false
+			}
+		} else if it.open {
+			it.buf = decodeVarints(it.openFirst, it.openN, it.openPayload, it.buf[:0])
+			it.open = false
+		} else {
+			return 0, false
+		}
+		it.pos = 0
+	}
+	id := it.buf[it.pos]
+	it.pos++
+	return id, true
+}
+
+// Err returns CorruptedErr, when the iteration was stopped by the wrong data
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// uvarint reads the next value of the block header
+func (it *Iterator) uvarint() (uint64, error) {
+	v, size := binary.Uvarint(it.data)
+	if size <= 0 {
+		return 0, CorruptedErr
+	}
+	it.data = it.data[size:]
+	return v, nil
+}
+
+func (it *Iterator) decodeBlock() error {
+	kind := it.data[0]
+	it.data = it.data[1:]
+	n, err := it.uvarint()
+	if err != nil {
+		return err
+	}
+	first, err := it.uvarint()
+	if err != nil {
+		return err
+	}
+	size, err := it.uvarint()
+	if err != nil {
+		return err
+	}
+	if n == 0 || n > BlockSize || first > uint64(^uint32(0)) || size > uint64(len(it.data)) {
+		return CorruptedErr
+	}
+	payload := it.data[:size]
+	it.data = it.data[size:]
+	ids := append(it.buf[:0], uint32(first))
+	switch kind {
+	case varintBlock:
+		prev := uint64(first)
+		for uint64(len(ids)) < n {
+			delta, size := binary.Uvarint(payload)
+			if size <= 0 {
+				return CorruptedErr
+			}
+			payload = payload[size:]
+			prev += delta
+			if prev > uint64(^uint32(0)) {
+				return CorruptedErr
+			}
+			ids = append(ids, uint32(prev))
+		}
+	case bitmapBlock:
+		ids = ids[:0]
+		for i, b := range payload {
+			for b != 0 {
+				bit := bits.TrailingZeros8(b)
+				b &= b - 1
+				id := first + uint64(8*i+bit)
+				if id > uint64(^uint32(0)) {
+					return CorruptedErr
+				}
+				ids = append(ids, uint32(id))
+			}
+		}
+		if uint64(len(ids)) != n {
+			return CorruptedErr
+		}
+	default:
+		return CorruptedErr
+	}
+	it.buf = ids
+	return nil
+}
@@ -0,0 +1,154 @@
+package postings
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func readAll(it *Iterator) ([]uint32, error) {
+	ids := make([]uint32, 0)
+	for id, ok := it.Next(); ok; id, ok = it.Next() {
+		ids = append(ids, id)
+	}
+	return ids, it.Err()
+}
+
+func TestList(t *testing.T) {
+	t.Run("Ascending", func(t *testing.T) {
+		l := NewList()
+		expected := make([]uint32, 0)
+		for i := uint32(0); i < 3*BlockSize+5; i++ {
+			l.Add(i * 3)
+			expected = append(expected, i*3)
+		}
+		if l.Len() != len(expected) {
+			t.Errorf("Expected %v ids, got %v", len(expected), l.Len())
+		}
+		ids, err := readAll(l.Iterator())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, expected) {
+			t.Errorf("Wrong ids: %v", ids)
+		}
+		if l.SizeBytes() >= 4*len(expected) {
+			t.Errorf("List must be smaller than raw uint32 ids, got %v bytes", l.SizeBytes())
+		}
+	})
+
+	t.Run("OutOfOrder", func(t *testing.T) {
+		l := NewList()
+		for _, id := range []uint32{10, 5, 7, 5, 1} {
+			l.Add(id)
+		}
+		ids := l.Ids()
+		// NOTE: duplicates are kept, ids of the open block are sorted
+		if !reflect.DeepEqual(ids, []uint32{1, 5, 5, 7, 10}) {
+			t.Errorf("Wrong ids: %v", ids)
+		}
+	})
+
+	t.Run("Random", func(t *testing.T) {
+		l := NewList()
+		expected := make([]uint32, 0)
+		for i := 0; i < 10*BlockSize; i++ {
+			id := uint32(rand.Intn(1 << 20))
+			l.Add(id)
+			expected = append(expected, id)
+		}
+		ids := l.Ids()
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+		if !reflect.DeepEqual(ids, expected) {
+			t.Error("List must hold all added ids")
+		}
+	})
+
+	t.Run("Snapshot", func(t *testing.T) {
+		l := NewList()
+		for i := uint32(0); i < BlockSize+2; i++ {
+			l.Add(i)
+		}
+		it := l.Iterator()
+		l.Add(0)
+		for i := uint32(0); i < BlockSize; i++ {
+			l.Add(1000 + i)
+		}
+		ids, err := readAll(it)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != BlockSize+2 || ids[len(ids)-1] != BlockSize+1 {
+			t.Errorf("Iterator must not see ids added after its creation, got %v", ids)
+		}
+	})
+}
+
+func TestBlocks(t *testing.T) {
+	dense := make([]uint32, BlockSize)
+	for i := range dense {
+		dense[i] = uint32(1000 + i)
+	}
+	sparse := []uint32{1, 1 << 10, 1 << 20, 1 << 30}
+
+	t.Run("Encoding", func(t *testing.T) {
+		if kind := AppendBlock(nil, dense)[0]; kind != bitmapBlock {
+			t.Error("Dense block must be stored as a bitmap")
+		}
+		if kind := AppendBlock(nil, sparse)[0]; kind != varintBlock {
+			t.Error("Sparse block must be stored as varints")
+		}
+		if kind := AppendBlock(nil, []uint32{1, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10})[0]; kind != varintBlock {
+			t.Error("Block with duplicates must be stored as varints")
+		}
+	})
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		l := NewList()
+		expected := append(append([]uint32{}, dense...), sparse...)
+		for _, id := range expected {
+			l.Add(id)
+		}
+		ids, err := readAll(NewIterator(l.AppendBinary(nil)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, expected) {
+			t.Errorf("Wrong ids: %v", ids)
+		}
+		ids, err = readAll(NewIterator(AppendIds(nil, expected)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, expected) {
+			t.Errorf("Wrong ids: %v", ids)
+		}
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		data := AppendIds(nil, append(append([]uint32{}, dense...), sparse...))
+		// NOTE: varint block of 3 ids, which payload ends in the middle of the varint
+		badPayload := append(AppendBlock(nil, sparse), varintBlock, 3, 5, 1, 0x80)
+		cases := []struct {
+			name     string
+			data     []byte
+			expected []uint32
+		}{
+			{"Truncated", data[:len(data)-1], dense},
+			{"Kind", append([]byte{7}, data[1:]...), []uint32{}},
+			{"Header", []byte{varintBlock, 0x80}, []uint32{}},
+			{"Payload", badPayload, sparse},
+		}
+		for _, c := range cases {
+			ids, err := readAll(NewIterator(c.data))
+			if err != CorruptedErr {
+				t.Errorf("%v: expected %v, got %v", c.name, CorruptedErr, err)
+			}
+			if !reflect.DeepEqual(ids, c.expected) {
+				t.Errorf("%v: only ids of the valid blocks must be returned, got %v", c.name, ids)
+			}
+		}
+	})
+}
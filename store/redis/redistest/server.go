@@ -0,0 +1,473 @@
+// Package redistest provides minimal in-process RESP server,
+// so the redis store could be tested without the external redis
+package redistest
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	protocolErr = errors.New("Malformed RESP command")
+)
+
+const wrongTypeReply = "WRONGTYPE Operation against a key holding the wrong kind of value"
+
+// Server keeps strings, lists and sets in memory and supports the subset of commands,
+// which is used by the redis store: PING, GET, SET, MSET, DEL, RPUSH, LRANGE, LLEN,
+// SADD, SMEMBERS, SCAN (only `prefix*` patterns) and FLUSHALL
+type Server struct {
+	mx       sync.Mutex
+	listener net.Listener
+	strs     map[string][]byte
+	lists    map[string][]string
+	sets     map[string]map[string]bool
+	conns    map[net.Conn]bool
+	// NOTE: cursors keep the last returned key, so keys deleted between SCAN calls don't shift the rest
+	cursors    map[int]string
+	nextCursor int
+	wg         sync.WaitGroup
+}
+
+// NewServer starts server on the random local port
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		listener: listener,
+		strs:     make(map[string][]byte),
+		lists:    make(map[string][]string),
+		sets:     make(map[string]map[string]bool),
+		conns:    make(map[net.Conn]bool),
+		cursors:  make(map[int]string),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns address to connect to
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server and drops all connections
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mx.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mx.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mx.Lock()
+		s.conns[conn] = true
+		s.mx.Unlock()
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mx.Lock()
+		delete(s.conns, conn)
+		s.mx.Unlock()
+		conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		s.execute(writer, args)
+		// NOTE: replies of the pipelined commands are flushed together
+		if reader.Buffered() == 0 {
+			err = writer.Flush()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", protocolErr
+	}
+	return line[:len(line)-2], nil
+}
+
+// readCommand reads an array of bulk strings
+func readCommand(reader *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if line[0] != '*' {
+		return nil, protocolErr
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n <= 0 {
+		return nil, protocolErr
+	}
+	args := make([][]byte, n)
+	for i := range args {
+		line, err = readLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if line[0] != '$' {
+			return nil, protocolErr
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, protocolErr
+		}
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(reader, buf)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = buf[:size]
+	}
+	return args, nil
+}
+
+func writeSimple(w *bufio.Writer, s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func writeError(w *bufio.Writer, s string) {
+	w.WriteString("-" + s + "\r\n")
+}
+
+func writeInt(w *bufio.Writer, n int) {
+	w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func writeBulk(w *bufio.Writer, b []byte) {
+	if b == nil {
+		w.WriteString("$-1\r\n")
+		return
+	}
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func writeArray(w *bufio.Writer, items []string) {
+	w.WriteString("*" + strconv.Itoa(len(items)) + "\r\n")
+	for _, item := range items {
+		writeBulk(w, []byte(item))
+	}
+}
+
+// keyType returns type of the existing key or empty string
+func (s *Server) keyType(key string) string {
+	if _, ok := s.strs[key]; ok {
+		return "string"
+	}
+	if _, ok := s.lists[key]; ok {
+		return "list"
+	}
+	if _, ok := s.sets[key]; ok {
+		return "set"
+	}
+	return ""
+}
+
+func (s *Server) del(key string) bool {
+	t := s.keyType(key)
+	delete(s.strs, key)
+	delete(s.lists, key)
+	delete(s.sets, key)
+	return t != ""
+}
+
+// keys returns all keys in the sorted order
+func (s *Server) keys() []string {
+	keys := make([]string, 0, len(s.strs)+len(s.lists)+len(s.sets))
+	for key := range s.strs {
+		keys = append(keys, key)
+	}
+	for key := range s.lists {
+		keys = append(keys, key)
+	}
+	for key := range s.sets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func wrongArgs(w *bufio.Writer, name string) {
+	writeError(w, "ERR wrong number of arguments for '"+strings.ToLower(name)+"' command")
+}
+
+func (s *Server) execute(w *bufio.Writer, args [][]byte) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	name := strings.ToUpper(string(args[0]))
+	args = args[1:]
+	switch name {
+	case "PING":
+		writeSimple(w, "PONG")
+	case "SET":
+		if len(args) != 2 {
+			wrongArgs(w, name)
+			return
+		}
+		s.del(string(args[0]))
+		s.strs[string(args[0])] = append([]byte{}, args[1]...)
+		writeSimple(w, "OK")
+	case "MSET":
+		if len(args) == 0 || len(args)%2 != 0 {
+			wrongArgs(w, name)
+			return
+		}
+		for i := 0; i < len(args); i += 2 {
+			s.del(string(args[i]))
+			s.strs[string(args[i])] = append([]byte{}, args[i+1]...)
+		}
+		writeSimple(w, "OK")
+	case "GET":
+		if len(args) != 1 {
+			wrongArgs(w, name)
+			return
+		}
+		key := string(args[0])
+		if t := s.keyType(key); t != "" && t != "string" {
+			writeError(w, wrongTypeReply)
+			return
+		}
+		writeBulk(w, s.strs[key])
+	case "DEL":
+		if len(args) == 0 {
+			wrongArgs(w, name)
+			return
+		}
+		deleted := 0
+		for _, key := range args {
+			if s.del(string(key)) {
+				deleted++
+			}
+		}
+		writeInt(w, deleted)
+	case "RPUSH":
+		if len(args) < 2 {
+			wrongArgs(w, name)
+			return
+		}
+		key := string(args[0])
+		if t := s.keyType(key); t != "" && t != "list" {
+			writeError(w, wrongTypeReply)
+			return
+		}
+		for _, value := range args[1:] {
+			s.lists[key] = append(s.lists[key], string(value))
+		}
+		writeInt(w, len(s.lists[key]))
+	case "LLEN":
+		if len(args) != 1 {
+			wrongArgs(w, name)
+			return
+		}
+		key := string(args[0])
+		if t := s.keyType(key); t != "" && t != "list" {
+			writeError(w, wrongTypeReply)
+			return
+		}
+		writeInt(w, len(s.lists[key]))
+	case "LRANGE":
+		if len(args) != 3 {
+			wrongArgs(w, name)
+			return
+		}
+		key := string(args[0])
+		if t := s.keyType(key); t != "" && t != "list" {
+			writeError(w, wrongTypeReply)
+			return
+		}
+		start, err1 := strconv.Atoi(string(args[1]))
+		stop, err2 := strconv.Atoi(string(args[2]))
+		if err1 != nil || err2 != nil {
+			writeError(w, "ERR value is not an integer or out of range")
+			return
+		}
+		writeArray(w, listRange(s.lists[key], start, stop))
+	case "SADD":
+		if len(args) < 2 {
+			wrongArgs(w, name)
+			return
+		}
+		key := string(args[0])
+		if t := s.keyType(key); t != "" && t != "set" {
+			writeError(w, wrongTypeReply)
+			return
+		}
+		set, ok := s.sets[key]
+		if !ok {
+			set = make(map[string]bool)
+			s.sets[key] = set
+		}
+		added := 0
+		for _, member := range args[1:] {
+			if !set[string(member)] {
+				set[string(member)] = true
+				added++
+			}
+		}
+		writeInt(w, added)
+	case "SMEMBERS":
+		if len(args) != 1 {
+			wrongArgs(w, name)
+			return
+		}
+		key := string(args[0])
+		if t := s.keyType(key); t != "" && t != "set" {
+			writeError(w, wrongTypeReply)
+			return
+		}
+		members := make([]string, 0, len(s.sets[key]))
+		for member := range s.sets[key] {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		writeArray(w, members)
+	case "SCAN":
+		s.scan(w, args)
+	case "FLUSHALL":
+		s.strs = make(map[string][]byte)
+		s.lists = make(map[string][]string)
+		s.sets = make(map[string]map[string]bool)
+		writeSimple(w, "OK")
+	default:
+		writeError(w, "ERR unknown command '"+strings.ToLower(name)+"'")
+	}
+}
+
+// listRange implements redis LRANGE indexes, including the negative ones
+func listRange(list []string, start, stop int) []string {
+	n := len(list)
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return []string{}
+	}
+	return list[start : stop+1]
+}
+
+// patternPrefix unescapes the pattern, which must be a literal prefix followed by the single star
+func patternPrefix(pattern string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+			if i == len(pattern) {
+				return "", false
+			}
+		case '*':
+			return b.String(), i == len(pattern)-1
+		case '?', '[':
+			return "", false
+		}
+		b.WriteByte(pattern[i])
+	}
+	return "", false
+}
+
+// scan returns keys matched by the prefix pattern in the sorted order
+func (s *Server) scan(w *bufio.Writer, args [][]byte) {
+	if len(args) == 0 {
+		wrongArgs(w, "SCAN")
+		return
+	}
+	cursor, err := strconv.Atoi(string(args[0]))
+	last, ok := s.cursors[cursor]
+	if err != nil || (cursor != 0 && !ok) {
+		writeError(w, "ERR invalid cursor")
+		return
+	}
+	delete(s.cursors, cursor)
+	prefix := ""
+	count := 10
+	for i := 1; i+1 < len(args); i += 2 {
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			prefix, ok = patternPrefix(string(args[i+1]))
+			if !ok {
+				writeError(w, "ERR only prefix patterns are supported")
+				return
+			}
+		case "COUNT":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count <= 0 {
+				writeError(w, "ERR syntax error")
+				return
+			}
+		}
+	}
+	keys := s.keys()
+	start := 0
+	if cursor != 0 {
+		start = sort.SearchStrings(keys, last)
+		if start < len(keys) && keys[start] == last {
+			start++
+		}
+	}
+	end := start + count
+	next := 0
+	if end < len(keys) {
+		s.nextCursor++
+		next = s.nextCursor
+		s.cursors[next] = keys[end-1]
+	} else {
+		end = len(keys)
+	}
+	matched := make([]string, 0)
+	for _, key := range keys[start:end] {
+		if strings.HasPrefix(key, prefix) {
+			matched = append(matched, key)
+		}
+	}
+	w.WriteString("*2\r\n")
+	writeBulk(w, []byte(strconv.Itoa(next)))
+	writeArray(w, matched)
+}
@@ -0,0 +1,151 @@
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+var (
+	protocolErr = errors.New("Malformed RESP reply")
+)
+
+// replyError is an error returned by the server
+type replyError string
+
+func (e replyError) Error() string {
+	return string(e)
+}
+
+// conn is a single connection speaking RESP
+type conn struct {
+	netConn net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	timeout time.Duration
+}
+
+func dial(addr string, timeout time.Duration) (*conn, error) {
+	netConn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{
+		netConn: netConn,
+		reader:  bufio.NewReader(netConn),
+		writer:  bufio.NewWriter(netConn),
+		timeout: timeout,
+	}, nil
+}
+
+// writeCommand encodes command as the array of bulk strings
+func (c *conn) writeCommand(args [][]byte) {
+	c.writer.WriteByte('*')
+	c.writer.WriteString(strconv.Itoa(len(args)))
+	c.writer.WriteString("\r\n")
+	for _, arg := range args {
+		c.writer.WriteByte('$')
+		c.writer.WriteString(strconv.Itoa(len(arg)))
+		c.writer.WriteString("\r\n")
+		c.writer.Write(arg)
+		c.writer.WriteString("\r\n")
+	}
+}
+
+func (c *conn) readLine() ([]byte, error) {
+	line, err := c.reader.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, protocolErr
+	}
+	return line[:len(line)-2], nil
+}
+
+// readReply returns string, []byte, int64, []interface{}, nil or replyError
+func (c *conn) readReply() (interface{}, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return replyError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, protocolErr
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(c.reader, buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:size], nil
+	case '*':
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, protocolErr
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, size)
+		for i := range items {
+			items[i], err = c.readReply()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, protocolErr
+}
+
+// pipeline sends all commands at once and reads their replies;
+// server errors are returned as replyError values, so the caller decides how to handle them
+func (c *conn) pipeline(ctx context.Context, cmds [][][]byte) ([]interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if c.timeout > 0 {
+		timeout := time.Now().Add(c.timeout)
+		if !ok || timeout.Before(deadline) {
+			deadline, ok = timeout, true
+		}
+	}
+	if ok {
+		c.netConn.SetDeadline(deadline)
+	} else {
+		c.netConn.SetDeadline(time.Time{})
+	}
+	for _, cmd := range cmds {
+		c.writeCommand(cmd)
+	}
+	err := c.writer.Flush()
+	if err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	for i := range replies {
+		replies[i], err = c.readReply()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+func (c *conn) close() error {
+	return c.netConn.Close()
+}
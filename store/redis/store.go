@@ -0,0 +1,518 @@
+package redis
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	unexpectedReplyErr = errors.New("Unexpected reply type")
+)
+
+const (
+	DefaultPrefix   = "lsh:"
+	DefaultPoolSize = 8
+	DefaultTimeout  = 5 * time.Second
+	DefaultPageSize = 1000
+)
+
+// Options holds redis connection settings
+type Options struct {
+	Addr string
+	// Prefix is prepended to every key, so several indexes could share one database
+	Prefix   string
+	PoolSize int
+	Timeout  time.Duration
+	// PageSize is a number of ids, which bucket iterator fetches with one request
+	PageSize int
+}
+
+// client keeps the pool of idle connections and tracks the checked out ones,
+// so all of them could be closed
+type client struct {
+	addr    string
+	timeout time.Duration
+	pool    chan *conn
+	mx      sync.Mutex
+	active  map[*conn]bool
+	closed  bool
+}
+
+func (c *client) get() (*conn, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.closed {
+		return nil, store.ClosedErr
+	}
+	var cn *conn
+	select {
+	case cn = <-c.pool:
+	default:
+		var err error
+		cn, err = dial(c.addr, c.timeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.active[cn] = true
+	return cn, nil
+}
+
+func (c *client) put(cn *conn) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	delete(c.active, cn)
+	if c.closed {
+		cn.close()
+		return
+	}
+	select {
+	case c.pool <- cn:
+	default:
+		cn.close()
+	}
+}
+
+// drop closes the checked out connection instead of returning it to the pool
+func (c *client) drop(cn *conn) {
+	c.mx.Lock()
+	delete(c.active, cn)
+	c.mx.Unlock()
+	cn.close()
+}
+
+// do sends commands with a single round trip and returns the first server error if any;
+// ctx deadline bounds the round trip, when it's earlier than the configured timeout
+func (c *client) do(ctx context.Context, cmds ...[][]byte) ([]interface{}, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	cn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	replies, err := cn.pipeline(ctx, cmds)
+	if err != nil {
+		// NOTE: connection state is unknown after the network failure, so it's dropped
+		c.drop(cn)
+		return nil, err
+	}
+	c.put(cn)
+	for _, reply := range replies {
+		if replyErr, ok := reply.(replyError); ok {
+			return nil, replyErr
+		}
+	}
+	return replies, nil
+}
+
+// close closes idle connections and the checked out ones,
+// which interrupts the requests in flight
+func (c *client) close() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.closed = true
+	for cn := range c.active {
+		cn.close()
+	}
+	c.active = make(map[*conn]bool)
+	for {
+		select {
+		case cn := <-c.pool:
+			cn.close()
+		default:
+			return
+		}
+	}
+}
+
+func command(name string, args ...[]byte) [][]byte {
+	return append([][]byte{[]byte(name)}, args...)
+}
+
+// RedisStore keeps vectors and codes as binary strings and buckets as lists,
+// every batch is written with a single pipelined request
+type RedisStore struct {
+	opts   Options
+	client *client
+}
+
+// NewRedisStore connects to the server and checks it with PING
+func NewRedisStore(opts Options) (*RedisStore, error) {
+	if opts.Prefix == "" {
+		opts.Prefix = DefaultPrefix
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = DefaultPoolSize
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.PageSize <= 0 {
+		opts.PageSize = DefaultPageSize
+	}
+	s := &RedisStore{
+		opts: opts,
+		client: &client{
+			addr:    opts.Addr,
+			timeout: opts.Timeout,
+			pool:    make(chan *conn, opts.PoolSize),
+			active:  make(map[*conn]bool),
+		},
+	}
+	_, err := s.client.do(context.Background(), command("PING"))
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *RedisStore) vecKey(id string) []byte {
+	return []byte(s.opts.Prefix + "v:" + id)
+}
+
+func (s *RedisStore) codeKey(id string) []byte {
+	return []byte(s.opts.Prefix + "c:" + id)
+}
+
+func (s *RedisStore) bucketKey(key store.BucketKey) []byte {
+	return []byte(s.opts.Prefix + "b:" + key.String())
+}
+
+// bucketsKey holds the set of all buckets keys, which is used by GetBucketsSizes
+func (s *RedisStore) bucketsKey() []byte {
+	return []byte(s.opts.Prefix + "buckets")
+}
+
+func encodeFloats(vec []float64) []byte {
+	buf := make([]byte, 8*len(vec))
+	for i, v := range vec {
+		binary.LittleEndian.PutUint64(buf[8*i:], math.Float64bits(v))
+	}
+	return buf
+}
+
+func decodeFloats(buf []byte) []float64 {
+	vec := make([]float64, len(buf)/8)
+	for i := range vec {
+		vec[i] = math.Float64frombits(binary.LittleEndian.Uint64(buf[8*i:]))
+	}
+	return vec
+}
+
+func (s *RedisStore) get(ctx context.Context, key []byte) ([]byte, error) {
+	replies, err := s.client.do(ctx, command("GET", key))
+	if err != nil {
+		return nil, err
+	}
+	if replies[0] == nil {
+		return nil, store.KeyNotFoundErr
+	}
+	value, ok := replies[0].([]byte)
+	if !ok {
+		return nil, unexpectedReplyErr
+	}
+	return value, nil
+}
+
+func (s *RedisStore) SetVector(ctx context.Context, id string, vec []float64) error {
+	_, err := s.client.do(ctx, command("SET", s.vecKey(id), encodeFloats(vec)))
+	return err
+}
+
+func (s *RedisStore) SetVectors(ctx context.Context, ids []string, vecs [][]float64) error {
+	if len(ids) != len(vecs) {
+		return store.BatchLengthErr
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([][]byte, 0, 2*len(ids))
+	for i, id := range ids {
+		args = append(args, s.vecKey(id), encodeFloats(vecs[i]))
+	}
+	_, err := s.client.do(ctx, command("MSET", args...))
+	return err
+}
+
+func (s *RedisStore) GetVector(ctx context.Context, id string) ([]float64, error) {
+	value, err := s.get(ctx, s.vecKey(id))
+	if err != nil {
+		return nil, err
+	}
+	return decodeFloats(value), nil
+}
+
+func (s *RedisStore) SetCode(ctx context.Context, id string, code []byte) error {
+	_, err := s.client.do(ctx, command("SET", s.codeKey(id), code))
+	return err
+}
+
+func (s *RedisStore) SetCodes(ctx context.Context, ids []string, codes [][]byte) error {
+	if len(ids) != len(codes) {
+		return store.BatchLengthErr
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([][]byte, 0, 2*len(ids))
+	for i, id := range ids {
+		args = append(args, s.codeKey(id), codes[i])
+	}
+	_, err := s.client.do(ctx, command("MSET", args...))
+	return err
+}
+
+func (s *RedisStore) GetCode(ctx context.Context, id string) ([]byte, error) {
+	return s.get(ctx, s.codeKey(id))
+}
+
+func (s *RedisStore) SetHash(ctx context.Context, key store.BucketKey, vecId string) error {
+	return s.SetHashes(ctx, map[store.BucketKey][]string{key: {vecId}})
+}
+
+// SetHashes pushes ids to the buckets lists and registers buckets keys in one pipeline
+func (s *RedisStore) SetHashes(ctx context.Context, hashes map[store.BucketKey][]string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	cmds := make([][][]byte, 0, len(hashes)+1)
+	registered := [][]byte{s.bucketsKey()}
+	for key, ids := range hashes {
+		if len(ids) == 0 {
+			continue
+		}
+		bucketKey := s.bucketKey(key)
+		args := make([][]byte, 0, len(ids)+1)
+		args = append(args, bucketKey)
+		for _, id := range ids {
+			args = append(args, []byte(id))
+		}
+		cmds = append(cmds, command("RPUSH", args...))
+		registered = append(registered, []byte(key.String()))
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+	cmds = append(cmds, command("SADD", registered...))
+	_, err := s.client.do(ctx, cmds...)
+	return err
+}
+
+// listIterator fetches bucket list page by page
+// NOTE: it reads the live list, so ids pushed during the iteration could be returned too
+type listIterator struct {
+	ctx   context.Context
+	s     *RedisStore
+	key   []byte
+	page  []string
+	pos   int
+	start int
+	done  bool
+	err   error
+}
+
+// fetch loads the next page, marking iterator as done on the short page
+func (it *listIterator) fetch() error {
+	end := it.start + it.s.opts.PageSize - 1
+	replies, err := it.s.client.do(it.ctx, command(
+		"LRANGE", it.key, []byte(strconv.Itoa(it.start)), []byte(strconv.Itoa(end)),
+	))
+	if err != nil {
+		return err
+	}
+	items, ok := replies[0].([]interface{})
+	if !ok {
+		return unexpectedReplyErr
+	}
+	it.page = it.page[:0]
+	for _, item := range items {
+		id, ok := item.([]byte)
+		if !ok {
+			return unexpectedReplyErr
+		}
+		it.page = append(it.page, string(id))
+	}
+	it.pos = 0
+	it.start += len(items)
+	it.done = len(items) < it.s.opts.PageSize
+	return nil
+}
+
+func (it *listIterator) Next() (string, bool) {
+	for it.pos >= len(it.page) {
+		if it.done || it.err != nil {
+			return "", false
+		}
+		it.err = it.fetch()
+		if it.err != nil {
+			return "", false
+		}
+	}
+	id := it.page[it.pos]
+	it.pos++
+	return id, true
+}
+
+func (it *listIterator) Err() error {
+	return it.err
+}
+
+func (it *listIterator) Close() error {
+	it.page = nil
+	it.done = true
+	return nil
+}
+
+// GetHashIterator fetches the first page right away, empty list means missing bucket
+func (s *RedisStore) GetHashIterator(ctx context.Context, key store.BucketKey) (store.Iterator, error) {
+	it := &listIterator{
+		ctx: ctx,
+		s:   s,
+		key: s.bucketKey(key),
+	}
+	err := it.fetch()
+	if err != nil {
+		return nil, err
+	}
+	if len(it.page) == 0 {
+		return nil, store.BucketNotFoundErr
+	}
+	return it, nil
+}
+
+// GetBucketsSizes requests lengths of all registered buckets in one pipeline
+func (s *RedisStore) GetBucketsSizes(ctx context.Context) (map[store.BucketKey]int, error) {
+	replies, err := s.client.do(ctx, command("SMEMBERS", s.bucketsKey()))
+	if err != nil {
+		return nil, err
+	}
+	members, ok := replies[0].([]interface{})
+	if !ok {
+		return nil, unexpectedReplyErr
+	}
+	keys := make([]store.BucketKey, len(members))
+	cmds := make([][][]byte, len(members))
+	for i, member := range members {
+		raw, ok := member.([]byte)
+		if !ok {
+			return nil, unexpectedReplyErr
+		}
+		keys[i], err = store.ParseBucketKey(string(raw))
+		if err != nil {
+			return nil, err
+		}
+		cmds[i] = command("LLEN", s.bucketKey(keys[i]))
+	}
+	sizes := make(map[store.BucketKey]int, len(keys))
+	if len(cmds) == 0 {
+		return sizes, nil
+	}
+	replies, err = s.client.do(ctx, cmds...)
+	if err != nil {
+		return nil, err
+	}
+	for i, reply := range replies {
+		size, ok := reply.(int64)
+		if !ok {
+			return nil, unexpectedReplyErr
+		}
+		sizes[keys[i]] = int(size)
+	}
+	return sizes, nil
+}
+
+// escapePattern escapes glob characters, so the string is matched literally
+func escapePattern(str string) string {
+	var b strings.Builder
+	for _, r := range str {
+		if strings.ContainsRune("*?[]\\", r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// scan calls fn with every page of keys matching the pattern,
+// NOTE: SCAN could return the same key more than once
+func (s *RedisStore) scan(ctx context.Context, pattern []byte, fn func(keys [][]byte) error) error {
+	count := []byte(strconv.Itoa(s.opts.PageSize))
+	cursor := []byte("0")
+	for {
+		replies, err := s.client.do(ctx, command("SCAN", cursor, []byte("MATCH"), pattern, []byte("COUNT"), count))
+		if err != nil {
+			return err
+		}
+		reply, ok := replies[0].([]interface{})
+		if !ok || len(reply) != 2 {
+			return unexpectedReplyErr
+		}
+		next, ok := reply[0].([]byte)
+		items, ok2 := reply[1].([]interface{})
+		if !ok || !ok2 {
+			return unexpectedReplyErr
+		}
+		if len(items) > 0 {
+			keys := make([][]byte, len(items))
+			for i, item := range items {
+				keys[i], ok = item.([]byte)
+				if !ok {
+					return unexpectedReplyErr
+				}
+			}
+			err = fn(keys)
+			if err != nil {
+				return err
+			}
+		}
+		if string(next) == "0" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// GetIdsIterator scans keys of the vectors and codes and returns iterator over their ids
+func (s *RedisStore) GetIdsIterator(ctx context.Context) (store.Iterator, error) {
+	seen := make(map[string]bool)
+	ids := make([]string, 0)
+	for _, prefix := range []string{s.opts.Prefix + "v:", s.opts.Prefix + "c:"} {
+		err := s.scan(ctx, []byte(escapePattern(prefix)+"*"), func(keys [][]byte) error {
+			for _, key := range keys {
+				id := string(key[len(prefix):])
+				if !seen[id] {
+					seen[id] = true
+					ids = append(ids, id)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return store.NewSliceIterator(ids), nil
+}
+
+// Clear removes all keys with the store prefix, scanning them in pages
+func (s *RedisStore) Clear(ctx context.Context) error {
+	return s.scan(ctx, []byte(escapePattern(s.opts.Prefix)+"*"), func(keys [][]byte) error {
+		_, err := s.client.do(ctx, command("DEL", keys...))
+		return err
+	})
+}
+
+// Close closes all connections, the store can't be used after that
+func (s *RedisStore) Close() error {
+	s.client.close()
+	return nil
+}
@@ -0,0 +1,185 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/redis/redistest"
+	"github.com/gasparian/lsh-search-go/store/storetest"
+	"reflect"
+	"testing"
+)
+
+func newTestStore(t testing.TB, pageSize int) (*RedisStore, func()) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewRedisStore(Options{Addr: server.Addr(), PageSize: pageSize})
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return s, func() {
+		s.Close()
+		server.Close()
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	ctx := context.Background()
+	s, closeStore := newTestStore(t, 2)
+	defer closeStore()
+
+	t.Run("Pages", func(t *testing.T) {
+		key := store.BucketKey{Tree: 0, Hash: 42}
+		ids := []string{"0", "1", "2", "3", "4"}
+		err := s.SetHashes(ctx, map[store.BucketKey][]string{key: ids})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// NOTE: page size is smaller than the bucket, so the iterator fetches several pages
+		it, err := s.GetHashIterator(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer it.Close()
+		read := make([]string, 0)
+		for id, ok := it.Next(); ok; id, ok = it.Next() {
+			read = append(read, id)
+		}
+		if it.Err() != nil {
+			t.Fatal(it.Err())
+		}
+		if !reflect.DeepEqual(read, ids) {
+			t.Errorf("Wrong bucket read by pages: %v", read)
+		}
+	})
+
+	t.Run("BinaryCode", func(t *testing.T) {
+		// NOTE: code holds bytes of the protocol delimiters
+		code := []byte{1, 0, 13, 10}
+		err := s.SetCode(ctx, "0", code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codeReturned, err := s.GetCode(ctx, "0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(code, codeReturned) {
+			t.Errorf("Wrong code: %v", codeReturned)
+		}
+	})
+
+	t.Run("Context", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := s.GetCode(canceled, "0")
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Canceled context must stop the request, got: %v", err)
+		}
+		_, err = s.GetCode(ctx, "0")
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestRedisStorePrefix(t *testing.T) {
+	ctx := context.Background()
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	// NOTE: glob characters of the prefix must be matched literally, so "a" keys aren't scanned
+	globbed, err := NewRedisStore(Options{Addr: server.Addr(), Prefix: "a*[b]?\\:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer globbed.Close()
+	other, err := NewRedisStore(Options{Addr: server.Addr(), Prefix: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	err = globbed.SetVector(ctx, "0", []float64{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.SetVector(ctx, "1", []float64{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := globbed.GetIdsIterator(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	ids := make([]string, 0)
+	for id, ok := it.Next(); ok; id, ok = it.Next() {
+		ids = append(ids, id)
+	}
+	if !reflect.DeepEqual(ids, []string{"0"}) {
+		t.Errorf("Only ids of the store must be returned, got %v", ids)
+	}
+	err = globbed.Clear(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.GetVector(ctx, "1")
+	if err != nil {
+		t.Errorf("Clear must not remove keys of the other store, got %v", err)
+	}
+}
+
+func TestRedisStoreClose(t *testing.T) {
+	ctx := context.Background()
+	s, closeStore := newTestStore(t, 0)
+	defer closeStore()
+	cn, err := s.client.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cn.pipeline(ctx, [][][]byte{command("PING")})
+	if err == nil {
+		t.Error("Checked out connection must be closed")
+	}
+	s.client.put(cn)
+	_, err = s.GetCode(ctx, "0")
+	if !errors.Is(err, store.ClosedErr) {
+		t.Errorf("Closed store must return %v, got %v", store.ClosedErr, err)
+	}
+}
+
+func TestRedisStoreSearch(t *testing.T) {
+	s, closeStore := newTestStore(t, 0)
+	defer closeStore()
+	storetest.RunSearch(t, s)
+}
+
+func TestConformance(t *testing.T) {
+	ctx := context.Background()
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	storetest.RunConformance(t, func() store.Store {
+		s, err := NewRedisStore(Options{Addr: server.Addr()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// NOTE: cases share the server, so every store starts from the empty database
+		err = s.Clear(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
@@ -0,0 +1,234 @@
+package sharded
+
+import (
+	"context"
+	"github.com/gasparian/lsh-search-go/store"
+	"hash/fnv"
+	"sync"
+)
+
+const (
+	DefaultShardsNumber = 32
+)
+
+// vecShard holds part of vectors and codes
+type vecShard struct {
+	mx    sync.RWMutex
+	vecs  map[string][]float64
+	codes map[string][]byte
+}
+
+// bucketShard holds part of buckets as append-only lists of vectors ids
+type bucketShard struct {
+	mx      sync.RWMutex
+	buckets map[store.BucketKey][]string
+}
+
+// ShardedStore is in-memory store, where vectors and buckets are spread
+// over N shards by the key hash, and each shard is guarded by its own lock,
+// so concurrent writes and searches don't wait on a single mutex
+type ShardedStore struct {
+	vecShards    []*vecShard
+	bucketShards []*bucketShard
+}
+
+// NewShardedStore creates store with the given number of shards for vectors and buckets
+func NewShardedStore(nShards int) *ShardedStore {
+	if nShards <= 0 {
+		nShards = DefaultShardsNumber
+	}
+	s := &ShardedStore{
+		vecShards:    make([]*vecShard, nShards),
+		bucketShards: make([]*bucketShard, nShards),
+	}
+	for i := 0; i < nShards; i++ {
+		s.vecShards[i] = &vecShard{
+			vecs:  make(map[string][]float64),
+			codes: make(map[string][]byte),
+		}
+		s.bucketShards[i] = &bucketShard{
+			buckets: make(map[store.BucketKey][]string),
+		}
+	}
+	return s
+}
+
+func (s *ShardedStore) vecShardIdx(id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % uint32(len(s.vecShards)))
+}
+
+func (s *ShardedStore) bucketShardIdx(key store.BucketKey) int {
+	// NOTE: splitmix64 finalizer to spread sequential leaf ids
+	h := key.Hash + uint64(key.Tree)*0x9e3779b97f4a7c15
+	h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+	h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+	h ^= h >> 31
+	return int(h % uint64(len(s.bucketShards)))
+}
+
+func (s *ShardedStore) SetVector(ctx context.Context, id string, vec []float64) error {
+	shard := s.vecShards[s.vecShardIdx(id)]
+	shard.mx.Lock()
+	defer shard.mx.Unlock()
+	shard.vecs[id] = vec
+	return nil
+}
+
+// SetVectors groups vectors by shard, so every shard is locked once per batch
+func (s *ShardedStore) SetVectors(ctx context.Context, ids []string, vecs [][]float64) error {
+	if len(ids) != len(vecs) {
+		return store.BatchLengthErr
+	}
+	groups := make(map[int][]int)
+	for i, id := range ids {
+		idx := s.vecShardIdx(id)
+		groups[idx] = append(groups[idx], i)
+	}
+	for idx, positions := range groups {
+		shard := s.vecShards[idx]
+		shard.mx.Lock()
+		for _, i := range positions {
+			shard.vecs[ids[i]] = vecs[i]
+		}
+		shard.mx.Unlock()
+	}
+	return nil
+}
+
+func (s *ShardedStore) GetVector(ctx context.Context, id string) ([]float64, error) {
+	shard := s.vecShards[s.vecShardIdx(id)]
+	shard.mx.RLock()
+	defer shard.mx.RUnlock()
+	vec, ok := shard.vecs[id]
+	if !ok {
+		return nil, store.KeyNotFoundErr
+	}
+	return vec, nil
+}
+
+func (s *ShardedStore) SetCode(ctx context.Context, id string, code []byte) error {
+	shard := s.vecShards[s.vecShardIdx(id)]
+	shard.mx.Lock()
+	defer shard.mx.Unlock()
+	shard.codes[id] = code
+	return nil
+}
+
+func (s *ShardedStore) SetCodes(ctx context.Context, ids []string, codes [][]byte) error {
+	if len(ids) != len(codes) {
+		return store.BatchLengthErr
+	}
+	groups := make(map[int][]int)
+	for i, id := range ids {
+		idx := s.vecShardIdx(id)
+		groups[idx] = append(groups[idx], i)
+	}
+	for idx, positions := range groups {
+		shard := s.vecShards[idx]
+		shard.mx.Lock()
+		for _, i := range positions {
+			shard.codes[ids[i]] = codes[i]
+		}
+		shard.mx.Unlock()
+	}
+	return nil
+}
+
+func (s *ShardedStore) GetCode(ctx context.Context, id string) ([]byte, error) {
+	shard := s.vecShards[s.vecShardIdx(id)]
+	shard.mx.RLock()
+	defer shard.mx.RUnlock()
+	code, ok := shard.codes[id]
+	if !ok {
+		return nil, store.KeyNotFoundErr
+	}
+	return code, nil
+}
+
+func (s *ShardedStore) SetHash(ctx context.Context, key store.BucketKey, vecId string) error {
+	shard := s.bucketShards[s.bucketShardIdx(key)]
+	shard.mx.Lock()
+	defer shard.mx.Unlock()
+	shard.buckets[key] = append(shard.buckets[key], vecId)
+	return nil
+}
+
+// SetHashes groups buckets by shard, so every shard is locked once per batch
+func (s *ShardedStore) SetHashes(ctx context.Context, hashes map[store.BucketKey][]string) error {
+	groups := make(map[int][]store.BucketKey)
+	for key := range hashes {
+		idx := s.bucketShardIdx(key)
+		groups[idx] = append(groups[idx], key)
+	}
+	for idx, keys := range groups {
+		shard := s.bucketShards[idx]
+		shard.mx.Lock()
+		for _, key := range keys {
+			shard.buckets[key] = append(shard.buckets[key], hashes[key]...)
+		}
+		shard.mx.Unlock()
+	}
+	return nil
+}
+
+// GetHashIterator returns iterator over the current bucket state;
+// buckets are append-only, so the iterator just holds the slice without copying
+func (s *ShardedStore) GetHashIterator(ctx context.Context, key store.BucketKey) (store.Iterator, error) {
+	shard := s.bucketShards[s.bucketShardIdx(key)]
+	shard.mx.RLock()
+	defer shard.mx.RUnlock()
+	bucket, ok := shard.buckets[key]
+	if !ok {
+		return nil, store.BucketNotFoundErr
+	}
+	return store.NewSliceIterator(bucket[:len(bucket):len(bucket)]), nil
+}
+
+// GetIdsIterator returns iterator over the snapshot of ids of the stored vectors and codes,
+// shards are locked one by one
+func (s *ShardedStore) GetIdsIterator(ctx context.Context) (store.Iterator, error) {
+	ids := make([]string, 0)
+	for _, shard := range s.vecShards {
+		shard.mx.RLock()
+		for id := range shard.vecs {
+			ids = append(ids, id)
+		}
+		for id := range shard.codes {
+			if _, ok := shard.vecs[id]; !ok {
+				ids = append(ids, id)
+			}
+		}
+		shard.mx.RUnlock()
+	}
+	return store.NewSliceIterator(ids), nil
+}
+
+// GetBucketsSizes returns number of entries in every bucket
+func (s *ShardedStore) GetBucketsSizes(ctx context.Context) (map[store.BucketKey]int, error) {
+	sizes := make(map[store.BucketKey]int)
+	for _, shard := range s.bucketShards {
+		shard.mx.RLock()
+		for key, bucket := range shard.buckets {
+			sizes[key] = len(bucket)
+		}
+		shard.mx.RUnlock()
+	}
+	return sizes, nil
+}
+
+func (s *ShardedStore) Clear(ctx context.Context) error {
+	for _, shard := range s.vecShards {
+		shard.mx.Lock()
+		shard.vecs = make(map[string][]float64)
+		shard.codes = make(map[string][]byte)
+		shard.mx.Unlock()
+	}
+	for _, shard := range s.bucketShards {
+		shard.mx.Lock()
+		shard.buckets = make(map[store.BucketKey][]string)
+		shard.mx.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package sharded
+
+import (
+	"context"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/lsh"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/kv"
+	"github.com/gasparian/lsh-search-go/store/storetest"
+	"math/rand"
+	"testing"
+)
+
+func TestShardRouting(t *testing.T) {
+	ctx := context.Background()
+	const nShards = 8
+
+	t.Run("DefaultShards", func(t *testing.T) {
+		s := NewShardedStore(0)
+		if len(s.vecShards) != DefaultShardsNumber || len(s.bucketShards) != DefaultShardsNumber {
+			t.Errorf("Expected %v shards by default", DefaultShardsNumber)
+		}
+	})
+
+	t.Run("Vectors", func(t *testing.T) {
+		s := NewShardedStore(nShards)
+		ids := make([]string, 100)
+		vecs := make([][]float64, len(ids))
+		for i := range ids {
+			ids[i] = fmt.Sprint(i)
+			vecs[i] = []float64{float64(i)}
+		}
+		err := s.SetVectors(ctx, ids, vecs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.SetCodes(ctx, ids, make([][]byte, len(ids)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		used := 0
+		for idx, shard := range s.vecShards {
+			if len(shard.vecs) > 0 {
+				used++
+			}
+			for id := range shard.vecs {
+				if s.vecShardIdx(id) != idx {
+					t.Errorf("Vector %v is stored in the shard %v instead of %v", id, idx, s.vecShardIdx(id))
+				}
+				if _, ok := shard.codes[id]; !ok {
+					t.Errorf("Code %v must be stored next to its vector", id)
+				}
+			}
+		}
+		if used < 2 {
+			t.Error("Batch must be spread over the shards")
+		}
+	})
+
+	t.Run("Buckets", func(t *testing.T) {
+		s := NewShardedStore(nShards)
+		const nKeys = 1000
+		hashes := make(map[store.BucketKey][]string)
+		for i := 0; i < nKeys; i++ {
+			// NOTE: leaf ids are sequential, so they must not be routed by the plain modulo
+			hashes[store.BucketKey{Tree: i % 4, Hash: uint64(i * nShards)}] = []string{fmt.Sprint(i)}
+		}
+		err := s.SetHashes(ctx, hashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for idx, shard := range s.bucketShards {
+			if len(shard.buckets) > 2*nKeys/nShards {
+				t.Errorf("Shard %v holds too many buckets: %v", idx, len(shard.buckets))
+			}
+			for key := range shard.buckets {
+				if s.bucketShardIdx(key) != idx {
+					t.Errorf("Bucket %v is stored in the shard %v instead of %v", key, idx, s.bucketShardIdx(key))
+				}
+			}
+		}
+	})
+}
+
+func benchmarkTrain(b *testing.B, newStore func() store.Store) {
+	const (
+		nVecs = 5000
+		dims  = 32
+	)
+	vecs := make([][]float64, nVecs)
+	ids := make([]string, nVecs)
+	for i := range vecs {
+		vecs[i] = make([]float64, dims)
+		for j := range vecs[i] {
+			vecs[i][j] = rand.NormFloat64()
+		}
+		ids[i] = fmt.Sprint(i)
+	}
+	config := lsh.Config{
+		IndexConfig: lsh.IndexConfig{
+			BatchSize:     100,
+			MaxCandidates: 1000,
+		},
+		HasherConfig: lsh.HasherConfig{
+			NTrees:   20,
+			KMinVecs: 50,
+			Dims:     dims,
+		},
+	}
+	index, err := lsh.NewLsh(config, newStore(), lsh.NewL2())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := index.Train(vecs, ids)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkTrain compares training throughput with the single-lock store, makes sense with -race too
+func BenchmarkTrain(b *testing.B) {
+	b.Run("KVStore", func(b *testing.B) {
+		benchmarkTrain(b, func() store.Store { return kv.NewKVStore() })
+	})
+	b.Run("ShardedStore", func(b *testing.B) {
+		benchmarkTrain(b, func() store.Store { return NewShardedStore(DefaultShardsNumber) })
+	})
+}
+
+func TestConformance(t *testing.T) {
+	storetest.RunConformance(t, func() store.Store { return NewShardedStore(4) })
+}
@@ -1,18 +1,153 @@
 package store
 
-// Iterator consists from only one method which returns uid of the next vector
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	bucketKeyFormatErr = errors.New("Bucket key must be in the `tree_hash` format")
+	bucketKeySizeErr   = errors.New("Binary bucket key must be 16 bytes long")
+)
+
+// Errors which stores return (or wrap), so callers could tell them apart
+// from the backend failures with errors.Is
+var (
+	KeyNotFoundErr    = errors.New("Key not found")
+	BucketNotFoundErr = errors.New("Bucket not found")
+	ClosedErr         = errors.New("Store is closed")
+	BatchLengthErr    = errors.New("Number of ids must be equal to the number of values")
+)
+
+// BucketKeySize is a length of the binary encoded bucket key
+const BucketKeySize = 16
+
+// BucketKey identifies bucket by the tree index and the hash calculated by that tree
+type BucketKey struct {
+	Tree int
+	Hash uint64
+}
+
+// String encodes key as `tree_hash`, for backends which use string keys
+func (k BucketKey) String() string {
+	return strconv.Itoa(k.Tree) + "_" + strconv.FormatUint(k.Hash, 10)
+}
+
+// ParseBucketKey decodes key from the `tree_hash` string
+func ParseBucketKey(s string) (BucketKey, error) {
+	parts := strings.Split(s, "_")
+	if len(parts) != 2 {
+		return BucketKey{}, bucketKeyFormatErr
+	}
+	tree, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return BucketKey{}, bucketKeyFormatErr
+	}
+	hash, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return BucketKey{}, bucketKeyFormatErr
+	}
+	return BucketKey{Tree: tree, Hash: hash}, nil
+}
+
+// AppendBinary appends big-endian tree index and hash to the buffer,
+// so encoded keys of the same tree are sorted by hash
+func (k BucketKey) AppendBinary(buf []byte) []byte {
+	var b [BucketKeySize]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(k.Tree))
+	binary.BigEndian.PutUint64(b[8:], k.Hash)
+	return append(buf, b[:]...)
+}
+
+// MarshalBinary encodes key as 16 bytes
+func (k BucketKey) MarshalBinary() ([]byte, error) {
+	return k.AppendBinary(make([]byte, 0, BucketKeySize)), nil
+}
+
+// UnmarshalBinary decodes key from 16 bytes
+func (k *BucketKey) UnmarshalBinary(data []byte) error {
+	if len(data) != BucketKeySize {
+		return bucketKeySizeErr
+	}
+	k.Tree = int(binary.BigEndian.Uint64(data[:8]))
+	k.Hash = binary.BigEndian.Uint64(data[8:])
+	return nil
+}
+
+// Iterator returns uids of the bucket vectors one by one;
+// it must be closed after use, Err reports the failure which stopped the iteration
 type Iterator interface {
 	Next() (string, bool)
+	Err() error
+	Close() error
+}
+
+// SliceIterator iterates over the snapshot of the bucket
+type SliceIterator struct {
+	ids []string
+	pos int
+}
+
+// NewSliceIterator creates iterator over the given ids
+func NewSliceIterator(ids []string) *SliceIterator {
+	return &SliceIterator{ids: ids}
+}
+
+func (it *SliceIterator) Next() (string, bool) {
+	if it.pos >= len(it.ids) {
+		return "", false
+	}
+	id := it.ids[it.pos]
+	it.pos++
+	return id, true
+}
+
+func (it *SliceIterator) Err() error {
+	return nil
+}
+
+func (it *SliceIterator) Close() error {
+	it.ids = nil
+	return nil
+}
+
+// SingleStore holds methods which read and write entries one by one;
+// GetVector returns KeyNotFoundErr and GetHashIterator returns BucketNotFoundErr for the missing entries
+// GetBucketsSizes enumerates all buckets and GetIdsIterator enumerates ids of all vectors and codes
+type SingleStore interface {
+	SetVector(ctx context.Context, id string, vec []float64) error
+	GetVector(ctx context.Context, id string) ([]float64, error)
+	SetHash(ctx context.Context, key BucketKey, vecId string) error
+	GetHashIterator(ctx context.Context, key BucketKey) (Iterator, error)
+	GetBucketsSizes(ctx context.Context) (map[BucketKey]int, error)
+	GetIdsIterator(ctx context.Context) (Iterator, error)
+	Clear(ctx context.Context) error
 }
 
 // Store methods to be able to hold and use search index
 // It implies storage vectors at one place, and
 // LSH hashes with vectors uid in other places
 // to not duplicate vectors themselves
+// Batch methods let backends write many entries in a single call (or a round trip),
+// use WithBatches for the stores which only implement single writes
 type Store interface {
-	SetVector(id string, vec []float64) error
-	GetVector(id string) ([]float64, error)
-	SetHash(bucketName, vecId string) error
-	GetHashIterator(bucketName string) (Iterator, error)
-	Clear() error
+	SingleStore
+	SetVectors(ctx context.Context, ids []string, vecs [][]float64) error
+	SetHashes(ctx context.Context, hashes map[BucketKey][]string) error
+}
+
+// SingleCodeStore holds methods to read and write codes one by one
+type SingleCodeStore interface {
+	SetCode(ctx context.Context, id string, code []byte) error
+	GetCode(ctx context.Context, id string) ([]byte, error)
+}
+
+// CodeStore is implemented by stores which are able to hold
+// compressed vectors codes instead of the raw vectors
+type CodeStore interface {
+	SingleCodeStore
+	SetCodes(ctx context.Context, ids []string, codes [][]byte) error
 }
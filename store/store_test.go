@@ -0,0 +1,123 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestBucketKey(t *testing.T) {
+	key := BucketKey{Tree: 12, Hash: 1<<63 + 7}
+
+	t.Run("String", func(t *testing.T) {
+		parsed, err := ParseBucketKey(key.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != key {
+			t.Errorf("Parsed key %v differs from the initial one %v", parsed, key)
+		}
+		_, err = ParseBucketKey("12")
+		if err == nil {
+			t.Error("Key without hash must not be parsed")
+		}
+	})
+
+	t.Run("Binary", func(t *testing.T) {
+		b, err := key.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != BucketKeySize {
+			t.Fatalf("Encoded key must be %v bytes long, got %v", BucketKeySize, len(b))
+		}
+		var decoded BucketKey
+		err = decoded.UnmarshalBinary(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded != key {
+			t.Errorf("Decoded key %v differs from the initial one %v", decoded, key)
+		}
+		err = decoded.UnmarshalBinary(b[1:])
+		if err == nil {
+			t.Error("Short key must not be decoded")
+		}
+	})
+}
+
+// singleStore implements only single writes
+type singleStore struct {
+	vecs    map[string][]float64
+	buckets map[BucketKey][]string
+}
+
+func (s *singleStore) SetVector(ctx context.Context, id string, vec []float64) error {
+	s.vecs[id] = vec
+	return nil
+}
+
+func (s *singleStore) GetVector(ctx context.Context, id string) ([]float64, error) {
+	vec, ok := s.vecs[id]
+	if !ok {
+		return nil, KeyNotFoundErr
+	}
+	return vec, nil
+}
+
+func (s *singleStore) SetHash(ctx context.Context, key BucketKey, vecId string) error {
+	s.buckets[key] = append(s.buckets[key], vecId)
+	return nil
+}
+
+func (s *singleStore) GetHashIterator(ctx context.Context, key BucketKey) (Iterator, error) {
+	return nil, errors.New("Not implemented")
+}
+
+func (s *singleStore) GetBucketsSizes(ctx context.Context) (map[BucketKey]int, error) {
+	sizes := make(map[BucketKey]int)
+	for key, bucket := range s.buckets {
+		sizes[key] = len(bucket)
+	}
+	return sizes, nil
+}
+
+func (s *singleStore) GetIdsIterator(ctx context.Context) (Iterator, error) {
+	ids := make([]string, 0, len(s.vecs))
+	for id := range s.vecs {
+		ids = append(ids, id)
+	}
+	return NewSliceIterator(ids), nil
+}
+
+func (s *singleStore) Clear(ctx context.Context) error {
+	return nil
+}
+
+func TestWithBatches(t *testing.T) {
+	single := &singleStore{
+		vecs:    make(map[string][]float64),
+		buckets: make(map[BucketKey][]string),
+	}
+	ctx := context.Background()
+	s := WithBatches(single)
+	if _, ok := s.(CodeStore); ok {
+		t.Fatal("Adapter must not implement codes methods when the wrapped store doesn't")
+	}
+	err := s.SetVectors(ctx, []string{"0", "1"}, [][]float64{{0}, {1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetVectors(ctx, []string{"0"}, nil)
+	if !errors.Is(err, BatchLengthErr) {
+		t.Error("Batch with different number of ids and vectors must fail")
+	}
+	key := BucketKey{Tree: 1, Hash: 2}
+	err = s.SetHashes(ctx, map[BucketKey][]string{key: {"0", "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(single.vecs) != 2 || len(single.buckets[key]) != 2 {
+		t.Fatal("Batches must be written to the wrapped store")
+	}
+}
@@ -0,0 +1,485 @@
+// Package storetest checks that store.Store implementation follows the semantics expected by the index
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+const (
+	// LargeBucketSize is a number of entries written to the bucket in the large bucket case
+	LargeBucketSize   = 10000
+	concurrentWriters = 4
+	concurrentWrites  = 200
+)
+
+// RunConformance runs every case on the fresh store created by newStore,
+// missing entries and wrong batches must be reported with the store package errors;
+// stores implementing io.Closer are closed after every case,
+// codes methods are checked only for the stores implementing store.CodeStore.
+// NOTE: all vectors are 2D, so the stores with fixed-width records are covered too
+func RunConformance(t *testing.T, newStore func() store.Store) {
+	cases := []struct {
+		name string
+		run  func(ctx context.Context, t *testing.T, s store.Store)
+	}{
+		{"Vectors", testVectors},
+		{"VectorsBatch", testVectorsBatch},
+		{"Codes", testCodes},
+		{"Buckets", testBuckets},
+		{"BucketsBatch", testBucketsBatch},
+		{"IteratorExhaustion", testIteratorExhaustion},
+		{"LargeBucket", testLargeBucket},
+		{"Ids", testIds},
+		{"Clear", testClear},
+		{"Concurrent", testConcurrent},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			s := newStore()
+			if closer, ok := s.(io.Closer); ok {
+				defer closer.Close()
+			}
+			c.run(context.Background(), t, s)
+		})
+	}
+}
+
+// ReadBucket drains the bucket iterator and returns sorted ids
+func ReadBucket(ctx context.Context, s store.Store, key store.BucketKey) ([]string, error) {
+	it, err := s.GetHashIterator(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	ids := make([]string, 0)
+	for id, ok := it.Next(); ok; id, ok = it.Next() {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, it.Err()
+}
+
+func sortedIds(ids ...string) []string {
+	sorted := append([]string{}, ids...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+func testVectors(ctx context.Context, t *testing.T, s store.Store) {
+	vec := []float64{1, -2.5e10}
+	err := s.SetVector(ctx, "a", vec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	returned, err := s.GetVector(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vec, returned) {
+		t.Errorf("Vectors are not equal: %v vs %v", vec, returned)
+	}
+	_, err = s.GetVector(ctx, "missing")
+	if !errors.Is(err, store.KeyNotFoundErr) {
+		t.Errorf("Missing vector must return %v, got %v", store.KeyNotFoundErr, err)
+	}
+	updated := []float64{4, 5}
+	err = s.SetVector(ctx, "a", updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	returned, err = s.GetVector(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(updated, returned) {
+		t.Errorf("Vector must be overwritten: %v", returned)
+	}
+}
+
+func testVectorsBatch(ctx context.Context, t *testing.T, s store.Store) {
+	ids := []string{"a", "b", "c"}
+	vecs := [][]float64{{1, 1}, {2, 2}, {3, 3}}
+	err := s.SetVectors(ctx, ids, vecs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range ids {
+		returned, err := s.GetVector(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(vecs[i], returned) {
+			t.Errorf("Vectors are not equal: %v vs %v", vecs[i], returned)
+		}
+	}
+	err = s.SetVectors(ctx, ids, vecs[:1])
+	if !errors.Is(err, store.BatchLengthErr) {
+		t.Errorf("Batch with different number of ids and vectors must return %v, got %v", store.BatchLengthErr, err)
+	}
+	err = s.SetVectors(ctx, nil, nil)
+	if err != nil {
+		t.Errorf("Empty batch must not fail: %v", err)
+	}
+}
+
+func testCodes(ctx context.Context, t *testing.T, s store.Store) {
+	codes, ok := s.(store.CodeStore)
+	if !ok {
+		t.Skip("Store doesn't implement store.CodeStore")
+	}
+	code := []byte{0, 1, 255, '\r', '\n'}
+	err := codes.SetCode(ctx, "a", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	returned, err := codes.GetCode(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(code, returned) {
+		t.Errorf("Codes are not equal: %v vs %v", code, returned)
+	}
+	_, err = codes.GetCode(ctx, "missing")
+	if !errors.Is(err, store.KeyNotFoundErr) {
+		t.Errorf("Missing code must return %v, got %v", store.KeyNotFoundErr, err)
+	}
+	_, err = s.GetVector(ctx, "a")
+	if err == nil {
+		t.Error("Code must not be returned as a vector")
+	}
+	err = codes.SetCodes(ctx, []string{"b", "c"}, [][]byte{{2}, {3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	returned, err = codes.GetCode(ctx, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]byte{3}, returned) {
+		t.Errorf("Codes are not equal: %v", returned)
+	}
+	err = codes.SetCodes(ctx, []string{"b"}, nil)
+	if !errors.Is(err, store.BatchLengthErr) {
+		t.Errorf("Batch with different number of ids and codes must return %v, got %v", store.BatchLengthErr, err)
+	}
+}
+
+func testBuckets(ctx context.Context, t *testing.T, s store.Store) {
+	key := store.BucketKey{Tree: 0, Hash: 42}
+	other := store.BucketKey{Tree: 1, Hash: 42}
+	for _, id := range []string{"a", "b", "c"} {
+		err := s.SetHash(ctx, key, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := s.SetHash(ctx, other, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := ReadBucket(ctx, s, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, sortedIds("a", "b", "c")) {
+		t.Errorf("Wrong bucket content: %v", ids)
+	}
+	_, err = s.GetHashIterator(ctx, store.BucketKey{Tree: 0, Hash: 43})
+	if !errors.Is(err, store.BucketNotFoundErr) {
+		t.Errorf("Missing bucket must return %v, got %v", store.BucketNotFoundErr, err)
+	}
+	sizes, err := s.GetBucketsSizes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[store.BucketKey]int{key: 3, other: 1}
+	if !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("Wrong buckets sizes: %v", sizes)
+	}
+}
+
+func testBucketsBatch(ctx context.Context, t *testing.T, s store.Store) {
+	first := store.BucketKey{Tree: 0, Hash: 1}
+	second := store.BucketKey{Tree: 0, Hash: 2}
+	err := s.SetHashes(ctx, map[store.BucketKey][]string{
+		first:  {"a", "b"},
+		second: {"c"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// NOTE: the next batch appends to the existing bucket
+	err = s.SetHashes(ctx, map[store.BucketKey][]string{first: {"d"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := ReadBucket(ctx, s, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, sortedIds("a", "b", "d")) {
+		t.Errorf("Wrong bucket content: %v", ids)
+	}
+	ids, err = ReadBucket(ctx, s, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"c"}) {
+		t.Errorf("Wrong bucket content: %v", ids)
+	}
+	err = s.SetHashes(ctx, map[store.BucketKey][]string{})
+	if err != nil {
+		t.Errorf("Empty batch must not fail: %v", err)
+	}
+}
+
+func testIteratorExhaustion(ctx context.Context, t *testing.T, s store.Store) {
+	key := store.BucketKey{Tree: 2, Hash: 0}
+	err := s.SetHash(ctx, key, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := s.GetHashIterator(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, ok := it.Next()
+	if !ok || id != "a" {
+		t.Fatalf("Expected `a`, got %v, %v", id, ok)
+	}
+	for i := 0; i < 3; i++ {
+		_, ok = it.Next()
+		if ok {
+			t.Fatal("Exhausted iterator must keep returning false")
+		}
+	}
+	if it.Err() != nil {
+		t.Errorf("Exhausted iterator must not report an error: %v", it.Err())
+	}
+	err = it.Close()
+	if err != nil {
+		t.Errorf("Iterator must be closed without an error: %v", err)
+	}
+	// NOTE: iterator closed before exhaustion must not block the store
+	it, err = s.GetHashIterator(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.Close()
+	err = s.SetHash(ctx, key, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testLargeBucket(ctx context.Context, t *testing.T, s store.Store) {
+	key := store.BucketKey{Tree: 3, Hash: 7}
+	expected := make([]string, LargeBucketSize)
+	half := LargeBucketSize / 2
+	for i := range expected {
+		expected[i] = fmt.Sprint(i)
+	}
+	err := s.SetHashes(ctx, map[store.BucketKey][]string{key: expected[:half]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for start := half; start < LargeBucketSize; start += 1000 {
+		end := start + 1000
+		if end > LargeBucketSize {
+			end = LargeBucketSize
+		}
+		err = s.SetHashes(ctx, map[store.BucketKey][]string{key: expected[start:end]})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids, err := ReadBucket(ctx, s, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, sortedIds(expected...)) {
+		t.Errorf("Large bucket holds %v entries instead of %v", len(ids), len(expected))
+	}
+	sizes, err := s.GetBucketsSizes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizes[key] != LargeBucketSize {
+		t.Errorf("Wrong bucket size: %v", sizes[key])
+	}
+}
+
+// readIds drains the ids iterator and returns sorted ids
+func readIds(ctx context.Context, s store.Store) ([]string, error) {
+	it, err := s.GetIdsIterator(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	ids := make([]string, 0)
+	for id, ok := it.Next(); ok; id, ok = it.Next() {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, it.Err()
+}
+
+func testIds(ctx context.Context, t *testing.T, s store.Store) {
+	err := s.SetVectors(ctx, []string{"a", "b"}, [][]float64{{1, 2}, {3, 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"a", "b"}
+	if codes, ok := s.(store.CodeStore); ok {
+		err = codes.SetCode(ctx, "c", []byte{1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, "c")
+	}
+	// NOTE: ids which are only referenced by buckets are not listed
+	err = s.SetHashes(ctx, map[store.BucketKey][]string{{Tree: 0, Hash: 1}: {"a", "d"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := readIds(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("Expected ids %v, got %v", expected, ids)
+	}
+	err = s.Clear(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err = readIds(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("Ids must be removed by Clear, got %v", ids)
+	}
+}
+
+func testClear(ctx context.Context, t *testing.T, s store.Store) {
+	key := store.BucketKey{Tree: 0, Hash: 5}
+	err := s.SetVector(ctx, "a", []float64{1, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetHash(ctx, key, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Clear(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.GetVector(ctx, "a")
+	if !errors.Is(err, store.KeyNotFoundErr) {
+		t.Errorf("Vector must be removed by Clear, got %v", err)
+	}
+	_, err = s.GetHashIterator(ctx, key)
+	if !errors.Is(err, store.BucketNotFoundErr) {
+		t.Errorf("Bucket must be removed by Clear, got %v", err)
+	}
+	sizes, err := s.GetBucketsSizes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 0 {
+		t.Errorf("Buckets must be removed by Clear: %v", sizes)
+	}
+	// NOTE: store must be usable after Clear
+	err = s.SetVector(ctx, "b", []float64{2, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetHash(ctx, key, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := ReadBucket(ctx, s, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"b"}) {
+		t.Errorf("Wrong bucket content after Clear: %v", ids)
+	}
+}
+
+// testConcurrent writes vectors and buckets from several goroutines while others read them,
+// it makes sense with -race
+func testConcurrent(ctx context.Context, t *testing.T, s store.Store) {
+	key := store.BucketKey{Tree: 0, Hash: 0}
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 2*concurrentWriters)
+	for w := 0; w < concurrentWriters; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < concurrentWrites; i++ {
+				id := fmt.Sprintf("%v_%v", w, i)
+				err := s.SetVector(ctx, id, []float64{float64(w), float64(i)})
+				if err == nil {
+					err = s.SetHashes(ctx, map[store.BucketKey][]string{key: {id}})
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < concurrentWrites; i++ {
+				it, err := s.GetHashIterator(ctx, key)
+				if errors.Is(err, store.BucketNotFoundErr) {
+					continue // NOTE: bucket could be not created yet
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				// NOTE: vector is written before the hash, so it must be found for any id of the bucket
+				id, ok := it.Next()
+				if ok {
+					_, err = s.GetVector(ctx, id)
+				}
+				for ok && err == nil {
+					_, ok = it.Next()
+				}
+				if err == nil {
+					err = it.Err()
+				}
+				it.Close()
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	sizes, err := s.GetBucketsSizes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizes[key] != concurrentWriters*concurrentWrites {
+		t.Errorf("Expected %v entries, got %v", concurrentWriters*concurrentWrites, sizes[key])
+	}
+}
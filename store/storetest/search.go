@@ -0,0 +1,102 @@
+package storetest
+
+import (
+	"fmt"
+	"github.com/gasparian/lsh-search-go/lsh"
+	"github.com/gasparian/lsh-search-go/store"
+	"math/rand"
+	"testing"
+)
+
+// SearchDims is a dimensionality of the vectors used by RunSearch
+const SearchDims = 8
+
+const (
+	searchVecs = 300
+	searchNN   = 5
+	searchDist = 100
+)
+
+// SearchFixture holds the index trained by RunSearch together with its train set
+type SearchFixture struct {
+	Config lsh.Config
+	Vecs   [][]float64
+	Ids    []string
+	Index  *lsh.LSHIndex
+	// Expected holds neighbors of the first vector found by the trained index
+	Expected []lsh.Neighbor
+}
+
+// RunSearch trains the index over the store on random vectors and checks
+// that the first vector is its own closest neighbor
+func RunSearch(t *testing.T, s store.Store) *SearchFixture {
+	f := &SearchFixture{
+		Config: lsh.Config{
+			IndexConfig: lsh.IndexConfig{
+				BatchSize: 50,
+				// NOTE: some stores iterate buckets in random order, so candidates must not be cut
+				MaxCandidates: 1000,
+			},
+			HasherConfig: lsh.HasherConfig{
+				NTrees:   5,
+				KMinVecs: 20,
+				Dims:     SearchDims,
+			},
+		},
+		Vecs: make([][]float64, searchVecs),
+		Ids:  make([]string, searchVecs),
+	}
+	for i := range f.Vecs {
+		f.Vecs[i] = make([]float64, SearchDims)
+		for j := range f.Vecs[i] {
+			f.Vecs[i][j] = rand.NormFloat64()
+		}
+		f.Ids[i] = fmt.Sprint(i)
+	}
+	var err error
+	f.Index, err = lsh.NewLsh(f.Config, s, lsh.NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Index.Train(f.Vecs, f.Ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Expected, err = f.Index.Search(f.Vecs[0], searchNN, searchDist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Expected) == 0 || f.Expected[0].ID != f.Ids[0] {
+		t.Fatalf("Query vector must be the closest one, got: %v", f.Expected)
+	}
+	return f
+}
+
+// CheckServed loads the trained hasher into the new index over the served store
+// and checks that it finds the same neighbors as the trained index
+func (f *SearchFixture) CheckServed(t *testing.T, served store.Store) {
+	hasher, err := f.Index.DumpHasher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := lsh.NewLsh(f.Config, served, lsh.NewL2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = index.LoadHasher(hasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closest, err := index.Search(f.Vecs[0], searchNN, searchDist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(closest) != len(f.Expected) {
+		t.Fatalf("Expected %v neighbors, got %v", len(f.Expected), len(closest))
+	}
+	for i := range closest {
+		if closest[i].Dist != f.Expected[i].Dist {
+			t.Errorf("Neighbor %v differs: %v vs %v", i, closest[i], f.Expected[i])
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package tiered
+
+import (
+	"context"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/cached"
+	"github.com/gasparian/lsh-search-go/store/compact"
+	"github.com/gasparian/lsh-search-go/store/disk"
+)
+
+// Options holds tiered store settings
+type Options struct {
+	Disk disk.Options
+	// HotBytes is a size of the LRU cache of the vectors read from the disk, zero disables it
+	HotBytes int64
+}
+
+// TieredStore keeps bucket postings in memory, as compressed posting lists of the compact store,
+// and vectors with codes in the disk store, so search reads the disk only for the candidate vectors.
+// Postings are appended to the disk store log too, and they are loaded back to memory on reopening
+type TieredStore struct {
+	disk    *disk.DiskStore
+	vectors store.Store
+	codes   store.CodeStore
+	hot     cached.Store
+	buckets *compact.CompactStore
+}
+
+// NewTieredStore opens the disk part in the directory and loads existing postings to memory
+func NewTieredStore(dir string, opts Options) (*TieredStore, error) {
+	d, err := disk.NewDiskStore(dir, opts.Disk)
+	if err != nil {
+		return nil, err
+	}
+	s := &TieredStore{
+		disk:    d,
+		vectors: d,
+		codes:   d,
+		buckets: compact.NewCompactStore(),
+	}
+	if opts.HotBytes > 0 {
+		s.hot = cached.NewCachedStore(d, cached.Options{VectorsBytes: opts.HotBytes})
+		s.vectors = s.hot
+	}
+	err = s.load(context.Background())
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load copies postings of every bucket from the disk log to memory
+func (s *TieredStore) load(ctx context.Context) error {
+	sizes, err := s.disk.GetBucketsSizes(ctx)
+	if err != nil {
+		return err
+	}
+	for key := range sizes {
+		it, err := s.disk.GetHashIterator(ctx, key)
+		if err != nil {
+			return err
+		}
+		ids := make([]string, 0, sizes[key])
+		for id, ok := it.Next(); ok; id, ok = it.Next() {
+			ids = append(ids, id)
+		}
+		err = it.Err()
+		it.Close()
+		if err != nil {
+			return err
+		}
+		err = s.buckets.SetHashes(ctx, map[store.BucketKey][]string{key: ids})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HotStats returns counters of the hot vectors cache, they are zero when the cache is disabled
+func (s *TieredStore) HotStats() cached.CacheStats {
+	if s.hot == nil {
+		return cached.CacheStats{}
+	}
+	return s.hot.Stats().Vectors
+}
+
+// MemoryUsage estimates memory used by the in-memory postings
+func (s *TieredStore) MemoryUsage() compact.MemoryUsage {
+	return s.buckets.MemoryUsage()
+}
+
+func (s *TieredStore) SetVector(ctx context.Context, id string, vec []float64) error {
+	return s.vectors.SetVector(ctx, id, vec)
+}
+
+func (s *TieredStore) SetVectors(ctx context.Context, ids []string, vecs [][]float64) error {
+	return s.vectors.SetVectors(ctx, ids, vecs)
+}
+
+func (s *TieredStore) GetVector(ctx context.Context, id string) ([]float64, error) {
+	return s.vectors.GetVector(ctx, id)
+}
+
+func (s *TieredStore) SetCode(ctx context.Context, id string, code []byte) error {
+	return s.codes.SetCode(ctx, id, code)
+}
+
+func (s *TieredStore) SetCodes(ctx context.Context, ids []string, codes [][]byte) error {
+	return s.codes.SetCodes(ctx, ids, codes)
+}
+
+func (s *TieredStore) GetCode(ctx context.Context, id string) ([]byte, error) {
+	return s.codes.GetCode(ctx, id)
+}
+
+func (s *TieredStore) SetHash(ctx context.Context, key store.BucketKey, vecId string) error {
+	return s.SetHashes(ctx, map[store.BucketKey][]string{key: {vecId}})
+}
+
+// SetHashes appends postings to the disk log first, so the memory never holds postings which could be lost
+func (s *TieredStore) SetHashes(ctx context.Context, hashes map[store.BucketKey][]string) error {
+	err := s.disk.SetHashes(ctx, hashes)
+	if err != nil {
+		return err
+	}
+	return s.buckets.SetHashes(ctx, hashes)
+}
+
+func (s *TieredStore) GetHashIterator(ctx context.Context, key store.BucketKey) (store.Iterator, error) {
+	return s.buckets.GetHashIterator(ctx, key)
+}
+
+// GetBucketsSizes returns number of entries in every bucket
+func (s *TieredStore) GetBucketsSizes(ctx context.Context) (map[store.BucketKey]int, error) {
+	return s.buckets.GetBucketsSizes(ctx)
+}
+
+// GetIdsIterator returns iterator over the snapshot of ids of the stored vectors and codes
+func (s *TieredStore) GetIdsIterator(ctx context.Context) (store.Iterator, error) {
+	return s.disk.GetIdsIterator(ctx)
+}
+
+func (s *TieredStore) Clear(ctx context.Context) error {
+	err := s.vectors.Clear(ctx)
+	if err != nil {
+		return err
+	}
+	return s.buckets.Clear(ctx)
+}
+
+// Sync flushes the disk part
+func (s *TieredStore) Sync() error {
+	return s.disk.Sync()
+}
+
+// Close closes the disk part, the store must not be used after it
+func (s *TieredStore) Close() error {
+	return s.disk.Close()
+}
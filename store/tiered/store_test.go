@@ -0,0 +1,126 @@
+package tiered
+
+import (
+	"context"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/storetest"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestTieredStore(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "lsh-tiered-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewTieredStore(dir, Options{HotBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { s.Close() }()
+	key := store.BucketKey{Tree: 0, Hash: 42}
+
+	t.Run("Write", func(t *testing.T) {
+		err := s.SetVectors(ctx, []string{"a", "b"}, [][]float64{{1, 2}, {3, 4}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.SetCode(ctx, "a", []byte{1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.SetHashes(ctx, map[store.BucketKey][]string{key: {"a", "b"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			vec, err := s.GetVector(ctx, "b")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(vec, []float64{3, 4}) {
+				t.Errorf("Wrong vector: %v", vec)
+			}
+		}
+		stats := s.HotStats()
+		if stats.Hits != 1 || stats.Misses != 1 {
+			t.Errorf("Second read must be served by the hot cache: %+v", stats)
+		}
+		if s.MemoryUsage().Postings == 0 {
+			t.Error("Postings must be held in memory")
+		}
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		err := s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err = NewTieredStore(dir, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := storetest.ReadBucket(ctx, s, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, []string{"a", "b"}) {
+			t.Errorf("Postings must be loaded back to memory, got %v", ids)
+		}
+		vec, err := s.GetVector(ctx, "a")
+		if err != nil || !reflect.DeepEqual(vec, []float64{1, 2}) {
+			t.Errorf("Vector must survive reopening, got %v, %v", vec, err)
+		}
+		code, err := s.GetCode(ctx, "a")
+		if err != nil || !reflect.DeepEqual(code, []byte{1}) {
+			t.Errorf("Code must survive reopening, got %v, %v", code, err)
+		}
+		if stats := s.HotStats(); stats.Hits+stats.Misses != 0 {
+			t.Error("Disabled hot cache must not count lookups")
+		}
+	})
+}
+
+func TestTieredStoreSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lsh-tiered-search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := NewTieredStore(dir, Options{HotBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	f := storetest.RunSearch(t, s)
+	_, err = f.Index.Search(f.Vecs[0], 1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.HotStats().Hits == 0 {
+		t.Error("Repeated search must read vectors from the hot cache")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	root, err := ioutil.TempDir("", "lsh-tiered-conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	storetest.RunConformance(t, func() store.Store {
+		dir, err := ioutil.TempDir(root, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewTieredStore(dir, Options{HotBytes: 1 << 16})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
@@ -0,0 +1,456 @@
+// Package transfer moves the index data between stores without retraining:
+// Export streams every vector, code and bucket posting of the store to the portable binary format,
+// and Import replays it into any store.Store.
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/gasparian/lsh-search-go/store"
+	"io"
+	"math"
+	"sort"
+)
+
+var (
+	formatErr    = errors.New("Stream is not the store export")
+	versionErr   = errors.New("Unsupported export version")
+	recordErr    = errors.New("Unknown record in the export")
+	truncatedErr = errors.New("Export is truncated")
+	countsErr    = errors.New("Number of records doesn't match the export trailer")
+	codeStoreErr = errors.New("Store must implement store.CodeStore to import codes")
+)
+
+const (
+	magic   = "LSHSTORE"
+	version = 1
+
+	vectorRecord  = 'v'
+	codeRecord    = 'c'
+	postingRecord = 'b'
+	endRecord     = 'e'
+
+	// ChunkSize is a max number of ids in a single postings record
+	ChunkSize = 1024
+	// DefaultBatchSize is a number of entries written to the store with a single batch call
+	DefaultBatchSize = 1000
+)
+
+// Stats holds number of the transferred entries
+type Stats struct {
+	Vectors  int
+	Codes    int
+	Buckets  int
+	Postings int
+}
+
+// Options of the Import
+type Options struct {
+	BatchSize int
+}
+
+type writer struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+func (w *writer) uvarint(v uint64) {
+	n := binary.PutUvarint(w.buf[:binary.MaxVarintLen64], v)
+	w.w.Write(w.buf[:n])
+}
+
+func (w *writer) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.w.Write(b)
+}
+
+func (w *writer) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.w.WriteString(s)
+}
+
+func (w *writer) vector(id string, vec []float64) {
+	w.w.WriteByte(vectorRecord)
+	w.string(id)
+	w.uvarint(uint64(len(vec)))
+	for _, v := range vec {
+		binary.LittleEndian.PutUint64(w.buf[:8], math.Float64bits(v))
+		w.w.Write(w.buf[:8])
+	}
+}
+
+func (w *writer) code(id string, code []byte) {
+	w.w.WriteByte(codeRecord)
+	w.string(id)
+	w.bytes(code)
+}
+
+func (w *writer) postings(key store.BucketKey, ids []string) {
+	w.w.WriteByte(postingRecord)
+	w.w.Write(key.AppendBinary(w.buf[:0]))
+	w.uvarint(uint64(len(ids)))
+	for _, id := range ids {
+		w.string(id)
+	}
+}
+
+// Export writes all entries of the store to w: vectors and codes first,
+// then postings of every bucket in the order of the bucket keys, and the trailer with the counts
+// NOTE: the store must not be written during the export, otherwise the snapshot could be inconsistent
+func Export(ctx context.Context, s store.Store, w io.Writer) (Stats, error) {
+	stats := Stats{}
+	out := &writer{w: bufio.NewWriter(w), buf: make([]byte, store.BucketKeySize+binary.MaxVarintLen64)}
+	out.w.WriteString(magic)
+	out.w.WriteByte(version)
+
+	codes, _ := s.(store.CodeStore)
+	ids, err := s.GetIdsIterator(ctx)
+	if err != nil {
+		return stats, err
+	}
+	defer ids.Close()
+	for id, ok := ids.Next(); ok; id, ok = ids.Next() {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		vec, err := s.GetVector(ctx, id)
+		if err == nil {
+			out.vector(id, vec)
+			stats.Vectors++
+		} else if !errors.Is(err, store.KeyNotFoundErr) {
+			return stats, err
+		}
+		if codes == nil {
+			continue
+		}
+		code, err := codes.GetCode(ctx, id)
+		if err == nil {
+			out.code(id, code)
+			stats.Codes++
+		} else if !errors.Is(err, store.KeyNotFoundErr) {
+			return stats, err
+		}
+	}
+	err = ids.Err()
+	if err != nil {
+		return stats, err
+	}
+
+	sizes, err := s.GetBucketsSizes(ctx)
+	if err != nil {
+		return stats, err
+	}
+	keys := make([]store.BucketKey, 0, len(sizes))
+	for key := range sizes {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Tree != keys[j].Tree {
+			return keys[i].Tree < keys[j].Tree
+		}
+		return keys[i].Hash < keys[j].Hash
+	})
+	for _, key := range keys {
+		n, err := exportBucket(ctx, s, key, out)
+		if err != nil {
+			return stats, err
+		}
+		if n > 0 {
+			stats.Buckets++
+			stats.Postings += n
+		}
+	}
+
+	out.w.WriteByte(endRecord)
+	out.uvarint(uint64(stats.Vectors))
+	out.uvarint(uint64(stats.Codes))
+	out.uvarint(uint64(stats.Postings))
+	return stats, out.w.Flush()
+}
+
+// exportBucket writes bucket postings by chunks, bucket removed after the listing is skipped
+func exportBucket(ctx context.Context, s store.Store, key store.BucketKey, out *writer) (int, error) {
+	it, err := s.GetHashIterator(ctx, key)
+	if errors.Is(err, store.BucketNotFoundErr) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+	total := 0
+	chunk := make([]string, 0, ChunkSize)
+	for id, ok := it.Next(); ok; id, ok = it.Next() {
+		chunk = append(chunk, id)
+		if len(chunk) == ChunkSize {
+			out.postings(key, chunk)
+			total += len(chunk)
+			chunk = chunk[:0]
+		}
+	}
+	if len(chunk) > 0 {
+		out.postings(key, chunk)
+		total += len(chunk)
+	}
+	return total, it.Err()
+}
+
+type reader struct {
+	r *bufio.Reader
+}
+
+// noEOF turns the end of the stream in the middle of the record into truncatedErr
+func noEOF(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return truncatedErr
+	}
+	return err
+}
+
+func (r *reader) uvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(r.r)
+	return v, noEOF(err)
+}
+
+func (r *reader) bytes() ([]byte, error) {
+	n, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > math.MaxInt32 {
+		return nil, formatErr
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r.r, b)
+	return b, noEOF(err)
+}
+
+func (r *reader) string() (string, error) {
+	b, err := r.bytes()
+	return string(b), err
+}
+
+func (r *reader) vector() (string, []float64, error) {
+	id, err := r.string()
+	if err != nil {
+		return "", nil, err
+	}
+	dims, err := r.uvarint()
+	if err != nil {
+		return "", nil, err
+	}
+	if dims > math.MaxInt32/8 {
+		return "", nil, formatErr
+	}
+	buf := make([]byte, 8*dims)
+	_, err = io.ReadFull(r.r, buf)
+	if err != nil {
+		return "", nil, noEOF(err)
+	}
+	vec := make([]float64, dims)
+	for i := range vec {
+		vec[i] = math.Float64frombits(binary.LittleEndian.Uint64(buf[8*i:]))
+	}
+	return id, vec, nil
+}
+
+func (r *reader) postings() (store.BucketKey, []string, error) {
+	var key store.BucketKey
+	buf := make([]byte, store.BucketKeySize)
+	_, err := io.ReadFull(r.r, buf)
+	if err != nil {
+		return key, nil, noEOF(err)
+	}
+	key.UnmarshalBinary(buf)
+	n, err := r.uvarint()
+	if err != nil {
+		return key, nil, err
+	}
+	if n > ChunkSize {
+		return key, nil, formatErr
+	}
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i], err = r.string()
+		if err != nil {
+			return key, nil, err
+		}
+	}
+	return key, ids, nil
+}
+
+// batch accumulates entries and flushes them to the store by the batch calls
+type batch struct {
+	s          store.Store
+	size       int
+	vecIds     []string
+	vecs       [][]float64
+	codeIds    []string
+	codes      [][]byte
+	hashes     map[store.BucketKey][]string
+	nPostings  int
+	codeTarget store.CodeStore
+}
+
+func (b *batch) flushVectors(ctx context.Context) error {
+	if len(b.vecIds) > 0 {
+		err := b.s.SetVectors(ctx, b.vecIds, b.vecs)
+		if err != nil {
+			return err
+		}
+		b.vecIds, b.vecs = nil, nil
+	}
+	if len(b.codeIds) > 0 {
+		err := b.codeTarget.SetCodes(ctx, b.codeIds, b.codes)
+		if err != nil {
+			return err
+		}
+		b.codeIds, b.codes = nil, nil
+	}
+	return nil
+}
+
+func (b *batch) flushPostings(ctx context.Context) error {
+	if b.nPostings == 0 {
+		return nil
+	}
+	err := b.s.SetHashes(ctx, b.hashes)
+	if err != nil {
+		return err
+	}
+	b.hashes = make(map[store.BucketKey][]string)
+	b.nPostings = 0
+	return nil
+}
+
+// Import replays the export from r into the store, entries are added to the existing ones,
+// so the store should be cleared beforehand to get the exact copy;
+// the whole stream is validated by the trailer counts, but entries read before the failure stay in the store
+func Import(ctx context.Context, r io.Reader, s store.Store, opts Options) (Stats, error) {
+	stats := Stats{}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	in := &reader{r: bufio.NewReader(r)}
+	header := make([]byte, len(magic)+1)
+	_, err := io.ReadFull(in.r, header)
+	if err != nil || string(header[:len(magic)]) != magic {
+		return stats, formatErr
+	}
+	if header[len(magic)] != version {
+		return stats, versionErr
+	}
+	codeTarget, _ := s.(store.CodeStore)
+	b := &batch{
+		s:          s,
+		size:       opts.BatchSize,
+		hashes:     make(map[store.BucketKey][]string),
+		codeTarget: codeTarget,
+	}
+	buckets := make(map[store.BucketKey]bool)
+	for {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		kind, err := in.r.ReadByte()
+		if err != nil {
+			return stats, noEOF(err)
+		}
+		switch kind {
+		case vectorRecord:
+			id, vec, err := in.vector()
+			if err != nil {
+				return stats, err
+			}
+			b.vecIds = append(b.vecIds, id)
+			b.vecs = append(b.vecs, vec)
+			stats.Vectors++
+		case codeRecord:
+			if codeTarget == nil {
+				return stats, codeStoreErr
+			}
+			id, err := in.string()
+			if err != nil {
+				return stats, err
+			}
+			code, err := in.bytes()
+			if err != nil {
+				return stats, err
+			}
+			b.codeIds = append(b.codeIds, id)
+			b.codes = append(b.codes, code)
+			stats.Codes++
+		case postingRecord:
+			// NOTE: vectors go first, so postings never reference vectors which are not written yet
+			err := b.flushVectors(ctx)
+			if err != nil {
+				return stats, err
+			}
+			key, ids, err := in.postings()
+			if err != nil {
+				return stats, err
+			}
+			b.hashes[key] = append(b.hashes[key], ids...)
+			b.nPostings += len(ids)
+			buckets[key] = true
+			stats.Postings += len(ids)
+		case endRecord:
+			err := b.flushVectors(ctx)
+			if err != nil {
+				return stats, err
+			}
+			err = b.flushPostings(ctx)
+			if err != nil {
+				return stats, err
+			}
+			stats.Buckets = len(buckets)
+			return stats, checkTrailer(in, stats)
+		default:
+			return stats, recordErr
+		}
+		if len(b.vecIds)+len(b.codeIds) >= b.size {
+			err = b.flushVectors(ctx)
+		} else if b.nPostings >= b.size {
+			err = b.flushPostings(ctx)
+		}
+		if err != nil {
+			return stats, err
+		}
+	}
+}
+
+func checkTrailer(in *reader, stats Stats) error {
+	expected := []int{stats.Vectors, stats.Codes, stats.Postings}
+	for _, count := range expected {
+		n, err := in.uvarint()
+		if err != nil {
+			return err
+		}
+		if n != uint64(count) {
+			return countsErr
+		}
+	}
+	return nil
+}
+
+// Copy streams all entries from src to dst without the intermediate file,
+// dst is not cleared beforehand
+func Copy(ctx context.Context, dst, src store.Store, opts Options) (Stats, error) {
+	pr, pw := io.Pipe()
+	exported := make(chan error, 1)
+	go func() {
+		_, err := Export(ctx, src, pw)
+		pw.CloseWithError(err)
+		exported <- err
+	}()
+	stats, err := Import(ctx, pr, dst, opts)
+	// NOTE: unblock the exporter, when the import stopped early
+	pr.CloseWithError(err)
+	exportErr := <-exported
+	if err == nil {
+		err = exportErr
+	}
+	return stats, err
+}
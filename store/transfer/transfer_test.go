@@ -0,0 +1,166 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/gasparian/lsh-search-go/store"
+	"github.com/gasparian/lsh-search-go/store/compact"
+	"github.com/gasparian/lsh-search-go/store/disk"
+	"github.com/gasparian/lsh-search-go/store/kv"
+	"github.com/gasparian/lsh-search-go/store/storetest"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// vectorsOnly hides codes methods of the wrapped store
+type vectorsOnly struct {
+	store.Store
+}
+
+// checkEqual compares all entries of the stores
+func checkEqual(ctx context.Context, t *testing.T, expected, actual store.Store) {
+	it, err := expected.GetIdsIterator(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.Close()
+	for id, ok := it.Next(); ok; id, ok = it.Next() {
+		vec, err := expected.GetVector(ctx, id)
+		if err != nil {
+			continue
+		}
+		copied, err := actual.GetVector(ctx, id)
+		if err != nil {
+			t.Fatalf("Vector %v must be copied: %v", id, err)
+		}
+		if !reflect.DeepEqual(vec, copied) {
+			t.Errorf("Vector %v differs: %v vs %v", id, vec, copied)
+		}
+	}
+	sizes, err := expected.GetBucketsSizes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copiedSizes, err := actual.GetBucketsSizes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sizes, copiedSizes) {
+		t.Fatalf("Buckets sizes differ: %v vs %v", sizes, copiedSizes)
+	}
+	for key := range sizes {
+		ids, err := storetest.ReadBucket(ctx, expected, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copied, err := storetest.ReadBucket(ctx, actual, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, copied) {
+			t.Errorf("Bucket %v differs: %v vs %v", key, ids, copied)
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	src := kv.NewKVStore()
+	ids := make([]string, 0)
+	vecs := make([][]float64, 0)
+	for i := 0; i < 50; i++ {
+		ids = append(ids, fmt.Sprint(i))
+		vecs = append(vecs, []float64{float64(i), -float64(i)})
+	}
+	err := src.SetVectors(ctx, ids, vecs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = src.SetCodes(ctx, []string{"0", "code-only"}, [][]byte{{1, 2}, {3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := make([]string, 2*ChunkSize+1)
+	for i := range large {
+		large[i] = ids[i%len(ids)]
+	}
+	err = src.SetHashes(ctx, map[store.BucketKey][]string{
+		{Tree: 0, Hash: 1}: ids[:10],
+		{Tree: 1, Hash: 1}: ids[10:],
+		{Tree: 1, Hash: 2}: large,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	exported, err := Export(ctx, src, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Stats{Vectors: 50, Codes: 2, Buckets: 3, Postings: 50 + len(large)}
+	if exported != expected {
+		t.Errorf("Wrong export stats: %+v", exported)
+	}
+
+	t.Run("Import", func(t *testing.T) {
+		dst := compact.NewCompactStore()
+		imported, err := Import(ctx, bytes.NewReader(buf.Bytes()), dst, Options{BatchSize: 7})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if imported != exported {
+			t.Errorf("Wrong import stats: %+v", imported)
+		}
+		checkEqual(ctx, t, src, dst)
+		code, err := dst.GetCode(ctx, "code-only")
+		if err != nil || !reflect.DeepEqual(code, []byte{3}) {
+			t.Errorf("Code must be copied, got %v, %v", code, err)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		_, err := Import(ctx, bytes.NewReader(buf.Bytes()), vectorsOnly{kv.NewKVStore()}, Options{})
+		if err != codeStoreErr {
+			t.Errorf("Codes must not be imported into the store without codes, got %v", err)
+		}
+		_, err = Import(ctx, bytes.NewReader(buf.Bytes()[:buf.Len()-5]), kv.NewKVStore(), Options{})
+		if err != truncatedErr {
+			t.Errorf("Truncated export must return %v, got %v", truncatedErr, err)
+		}
+		// NOTE: the failed import must stop the export too
+		_, err = Copy(ctx, vectorsOnly{kv.NewKVStore()}, src, Options{})
+		if err != codeStoreErr {
+			t.Errorf("Copy must return the import error, got %v", err)
+		}
+		_, err = Import(ctx, bytes.NewReader([]byte("not an export")), kv.NewKVStore(), Options{})
+		if err != formatErr {
+			t.Errorf("Wrong stream must return %v, got %v", formatErr, err)
+		}
+	})
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "lsh-transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := kv.NewKVStore()
+	f := storetest.RunSearch(t, src)
+
+	dst, err := disk.NewDiskStore(dir, disk.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	_, err = Copy(ctx, dst, src, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEqual(ctx, t, src, dst)
+	f.CheckServed(t, dst)
+}